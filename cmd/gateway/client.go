@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+	"github.com/bign8/supergraph-top-n-challenge/lib/env"
+	"github.com/bign8/supergraph-top-n-challenge/lib/health"
+	"github.com/bign8/supergraph-top-n-challenge/lib/metrics"
+	"github.com/bign8/supergraph-top-n-challenge/lib/pool"
+	"github.com/bign8/supergraph-top-n-challenge/lib/wire"
+)
+
+// client multiplexes concurrent requests over one connection, matching responses to callers by ID.
+//
+// Writes are bounded by the caller's context deadline. Reads are shared, so the connection's read deadline
+// tracks the latest deadline of any pending request: if the service stops answering altogether the
+// connection breaks (and is replaced by the pool) instead of hanging forever.
+type client struct {
+	conn net.Conn
+
+	mu        sync.Mutex // guards everything below
+	enc       wire.Encoder
+	next      uint64
+	pending   map[uint64]pending
+	unbounded int       // pending requests without a deadline
+	readBy    time.Time // latest deadline of the pending requests
+	err       error     // sticky: set once the connection is broken
+}
+
+type pending struct {
+	ch      chan reply
+	bounded bool
+}
+
+type reply struct {
+	res any
+	err error
+}
+
+// decoder reads one response, returning its ID and whether more responses to the same request follow.
+type decoder func(wire.Decoder) (id uint64, res any, more bool, err error)
+
+// newClient starts demultiplexing responses from conn, which speaks enc and dec (see wire.Connect).
+func newClient(conn net.Conn, enc wire.Encoder, dec wire.Decoder, decode decoder) *client {
+	c := &client{
+		conn:    conn,
+		enc:     enc,
+		pending: make(map[uint64]pending),
+	}
+	go c.demux(dec, decode)
+	return c
+}
+
+func (c *client) demux(dec wire.Decoder, decode decoder) {
+	for {
+		id, res, more, err := decode(dec)
+		if err != nil {
+			c.fail(fmt.Errorf(`decode: %w`, err))
+			return
+		}
+		c.mu.Lock()
+		var p pending
+		var ok bool
+		if more { // streamed: pending until the last frame
+			p, ok = c.pending[id]
+		} else {
+			p, ok = c.removeLocked(id)
+		}
+		if ok { // sent under c.mu, as failLocked closes p.ch
+			select {
+			case p.ch <- reply{res: res}: // buffered for every expected frame
+			default: // the caller gave up, or the service sent more frames than expected
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// removeLocked forgets a pending request, relaxing the read deadline if it was the last one.
+func (c *client) removeLocked(id uint64) (pending, bool) {
+	p, ok := c.pending[id]
+	if !ok {
+		return p, false
+	}
+	delete(c.pending, id)
+	if !p.bounded {
+		c.unbounded--
+	}
+	if len(c.pending) == 0 {
+		c.readBy = time.Time{}
+	}
+	c.updateReadDeadlineLocked()
+	return p, true
+}
+
+func (c *client) updateReadDeadlineLocked() {
+	if c.err != nil {
+		return
+	}
+	if c.unbounded > 0 || len(c.pending) == 0 {
+		c.conn.SetReadDeadline(time.Time{})
+	} else {
+		c.conn.SetReadDeadline(c.readBy.Add(readGrace))
+	}
+}
+
+// readGrace lets callers observe their own context deadline before the shared read deadline breaks the connection.
+const readGrace = 50 * time.Millisecond
+
+// fail breaks the connection, failing every waiting caller with err.
+func (c *client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLocked(err)
+}
+
+func (c *client) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+		c.conn.Close()
+	}
+	for id, p := range c.pending {
+		select {
+		case p.ch <- reply{err: c.err}:
+		default: // full of frames; the reader finds c.err once they are drained
+		}
+		close(p.ch)
+		delete(c.pending, id)
+	}
+	c.unbounded = 0
+}
+
+// Broken reports whether the connection can no longer be used.
+func (c *client) Broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// Busy reports whether responses are still outstanding.
+func (c *client) Busy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending) > 0
+}
+
+// Close fails any outstanding requests and closes the connection.
+func (c *client) Close() error {
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+// send writes the request built for the next ID and returns a func that waits for its next response (of at
+// most frames) or for ctx to be done, whichever happens first.
+func (c *client) send(ctx context.Context, frames int, build func(id uint64) any) func() (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return func() (any, error) { return nil, err }
+	}
+	if c.err != nil {
+		err := c.err
+		return func() (any, error) { return nil, err }
+	}
+	c.next++
+	id := c.next
+	p := pending{ch: make(chan reply, frames)}
+	deadline, bounded := ctx.Deadline()
+	p.bounded = bounded
+	if !bounded {
+		c.unbounded++
+	} else if deadline.After(c.readBy) {
+		c.readBy = deadline
+	}
+	c.pending[id] = p
+	c.updateReadDeadlineLocked()
+
+	c.conn.SetWriteDeadline(deadline) // zero (no deadline) when unbounded
+	if err := c.enc.Encode(build(id)); err != nil {
+		c.failLocked(fmt.Errorf(`encode: %w`, err))
+	} else {
+		c.conn.SetWriteDeadline(time.Time{})
+	}
+
+	return func() (any, error) {
+		select {
+		case r, ok := <-p.ch:
+			if !ok {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				return nil, c.err
+			}
+			return r.res, r.err
+		case <-ctx.Done():
+			// the request stays pending (p.ch is buffered) so its deadline keeps bounding the read:
+			// a late response is dropped, while a service that never answers breaks the connection
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *client) postsBatch(ctx context.Context, limit int32, fields []string, threads []int32, after map[int32]domain.Cursor) func() (map[int32][]domain.Post, error) {
+	req := domain.PostsRequest{
+		Limit:   limit,
+		Threads: threads,
+		Version: domain.PostsPackedVersion, // services predating it answer with Records
+		Fields:  fields,
+		After:   after,
+		Headers: make(map[string]string, 3),
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(req.Headers))
+	domain.InjectDeadline(ctx, req.Headers)
+	wait := c.send(ctx, 1, func(id uint64) any {
+		req.ID = id
+		return req
+	})
+	return func() (map[int32][]domain.Post, error) {
+		res, err := wait()
+		if err != nil {
+			return nil, err
+		}
+		out := res.(domain.PostsResponse)
+		if out.Error != nil {
+			return nil, out.Error
+		}
+		if out.Packed != nil {
+			return out.Packed, nil
+		}
+		return out.Records, nil
+	}
+}
+
+// maxFrames bounds the frames a streamed threads response is split into, as each is buffered.
+const maxFrames = 256
+
+// threads sends req, streaming the threads in frames of req.Chunk if set: onChunk (if set) is called with
+// every frame's threads as it arrives, and the returned func waits for all of them.
+func (c *client) threads(ctx context.Context, req domain.ThreadsRequest, onChunk func([]domain.Thread)) func() (domain.ThreadsResponse, error) {
+	req.Version = domain.ThreadsVersion
+	req.Headers = make(map[string]string, 3)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(req.Headers))
+	domain.InjectDeadline(ctx, req.Headers)
+
+	// make request, buffering every expected frame: past maxFrames the threads are sent in a single one
+	frames := 1
+	if req.Chunk > 0 {
+		chunks := (int64(req.Limit) + int64(req.Chunk) - 1) / int64(req.Chunk) // in int32 a limit near MaxInt32 wraps
+		if chunks > maxFrames {
+			req.Chunk = 0
+		} else if chunks > 0 {
+			frames += int(chunks)
+		}
+	}
+	wait := c.send(ctx, frames, func(id uint64) any {
+		req.ID = id
+		return req
+	})
+
+	// process response
+	return func() (domain.ThreadsResponse, error) {
+		return collect(func() (domain.ThreadsResponse, error) {
+			res, err := wait()
+			if err != nil {
+				return domain.ThreadsResponse{}, err
+			}
+			return res.(domain.ThreadsResponse), nil
+		}, onChunk)
+	}
+}
+
+// collect reads the frames of a threads response from next, passing each frame's threads to onChunk (if set).
+// It returns the last frame, holding all of the threads.
+func collect(next func() (domain.ThreadsResponse, error), onChunk func([]domain.Thread)) (domain.ThreadsResponse, error) {
+	var threads []domain.Thread
+	for {
+		out, err := next()
+		if err != nil {
+			return domain.ThreadsResponse{}, err
+		}
+		if out.Error != nil {
+			return out, out.Error
+		}
+		if onChunk != nil && len(out.Threads) > 0 {
+			onChunk(out.Threads)
+		}
+		if !out.More {
+			if threads != nil {
+				out.Threads = append(threads, out.Threads...)
+			}
+			return out, nil
+		}
+		threads = append(threads, out.Threads...)
+	}
+}
+
+func decodePosts(dec wire.Decoder) (uint64, any, bool, error) {
+	var res domain.PostsResponse
+	err := dec.Decode(&res)
+	return res.ID, res, false, err
+}
+
+func decodeThreads(dec wire.Decoder) (uint64, any, bool, error) {
+	var res domain.ThreadsResponse
+	err := dec.Decode(&res)
+	return res.ID, res, res.More, err
+}
+
+// backend sends requests to the domain services, over the transport selected by TRANSPORT: the gob protocol
+// (see client, spoken in codec) or gRPC (see grpcBackend).
+type backend interface {
+	threads(ctx context.Context, req domain.ThreadsRequest, onChunk func([]domain.Thread)) func() (domain.ThreadsResponse, error)
+	postsBatch(ctx context.Context, limit int32, fields []string, threads []int32, after map[int32]domain.Cursor) func() (map[int32][]domain.Post, error)
+	checks() map[string]health.Check // readiness, by service
+	Close() error                    // once no requests are in flight
+}
+
+var services backend
+
+// codec serializes the gob protocol (WIRE_CODEC); services predating lib/wire only speak wire.Gob.
+var codec = wire.Gob
+
+func initBackend(transport string) error {
+	switch transport {
+	case `gob`:
+		b := newGobBackend()
+		metrics.Pool(`posts`, b.postsPool.Stats)
+		metrics.Pool(`threads`, b.threadsPool.Stats)
+		services = b
+	case `grpc`:
+		b, err := newGRPCBackend()
+		if err != nil {
+			return err
+		}
+		services = b
+	default:
+		return fmt.Errorf(`unknown transport %q`, transport)
+	}
+	return nil
+}
+
+// gobBackend sends requests over pooled clients.
+type gobBackend struct {
+	postsPool   *pool.Pool[*client]
+	threadsPool *pool.Pool[*client]
+}
+
+func newGobBackend() gobBackend {
+	return gobBackend{
+		postsPool:   pool.New(poolConfig, dialer(`posts`, `POSTS_HOST`, `[::]:8001`, decodePosts)),
+		threadsPool: pool.New(poolConfig, dialer(`threads`, `THREADS_HOST`, `[::]:8002`, decodeThreads)),
+	}
+}
+
+func (b gobBackend) threads(ctx context.Context, req domain.ThreadsRequest, onChunk func([]domain.Thread)) func() (domain.ThreadsResponse, error) {
+	c, err := b.threadsPool.Get(ctx)
+	if err != nil {
+		return func() (domain.ThreadsResponse, error) { return domain.ThreadsResponse{}, err }
+	}
+	wait := c.threads(ctx, req, onChunk)
+	b.threadsPool.Put(c) // others may pipeline onto c while we wait
+	return wait
+}
+
+func (b gobBackend) postsBatch(ctx context.Context, limit int32, fields []string, threads []int32, after map[int32]domain.Cursor) func() (map[int32][]domain.Post, error) {
+	c, err := b.postsPool.Get(ctx)
+	if err != nil {
+		return func() (map[int32][]domain.Post, error) { return nil, err }
+	}
+	wait := c.postsBatch(ctx, limit, fields, threads, after)
+	b.postsPool.Put(c) // others may pipeline onto c while we wait
+	return wait
+}
+
+func (b gobBackend) checks() map[string]health.Check {
+	return map[string]health.Check{
+		`posts`: func(ctx context.Context) error {
+			return ping(ctx, b.postsPool, func(id uint64) any { return domain.PostsRequest{ID: id, Ping: true} })
+		},
+		`threads`: func(ctx context.Context) error {
+			return ping(ctx, b.threadsPool, func(id uint64) any {
+				return domain.ThreadsRequest{ID: id, Version: domain.ThreadsVersion, Ping: true}
+			})
+		},
+	}
+}
+
+// ping sends the ping built for the next ID on a pooled client (dialing one if none is idle) and waits for its
+// answer; a client that never answers breaks once ctx is done, and is replaced by the pool.
+func ping(ctx context.Context, p *pool.Pool[*client], build func(id uint64) any) error {
+	c, err := p.Get(ctx)
+	if err != nil {
+		return err
+	}
+	wait := c.send(ctx, 1, build)
+	p.Put(c)
+	_, err = wait()
+	return err
+}
+
+func (b gobBackend) Close() error {
+	return errors.Join(b.postsPool.Close(), b.threadsPool.Close())
+}
+
+// poolConfig bounds the multiplexed connections to each backend; a client is only checked out
+// while a request is being written, so a handful of connections go a long way.
+var poolConfig = pool.Config{
+	Min:         2,
+	Max:         16,
+	DialTimeout: time.Second,
+	IdleTimeout: time.Minute,
+	Backoff:     50 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+}
+
+func dialer(name, hostEnv, fallback string, decode decoder) func(context.Context) (*client, error) {
+	var d net.Dialer
+	return func(ctx context.Context) (*client, error) {
+		conn, err := d.DialContext(ctx, `tcp`, env.Default(hostEnv, fallback))
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline) // bounds the handshake
+		}
+		enc, dec, err := wire.Connect(conn, codec)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		log.Printf(`New connection to %s: %v (%s)`, name, conn.LocalAddr(), codec.Name())
+		return newClient(conn, enc, dec, decode), nil
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+func gobClient(conn net.Conn, decode decoder) *client {
+	return newClient(conn, gob.NewEncoder(conn), gob.NewDecoder(conn), decode)
+}
+
+func TestClientDemux(t *testing.T) {
+	server, conn := net.Pipe()
+	c := gobClient(conn, decodePosts)
+	defer conn.Close()
+
+	// net.Pipe is unbuffered, so the fake server has to read while requests are sent
+	var reqs [2]domain.PostsRequest
+	read := make(chan error)
+	go func() {
+		dec := gob.NewDecoder(server)
+		for i := range reqs {
+			if err := dec.Decode(&reqs[i]); err != nil {
+				read <- err
+				return
+			}
+		}
+		read <- nil
+	}()
+	first := c.postsBatch(context.Background(), 1, nil, []int32{1}, nil)
+	second := c.postsBatch(context.Background(), 1, nil, []int32{2}, nil)
+	require.NoError(t, <-read)
+
+	assert.Equal(t, int32(domain.PostsPackedVersion), reqs[0].Version)
+
+	// answer in reverse order, the second one packed
+	enc := gob.NewEncoder(server)
+	for i := len(reqs) - 1; i >= 0; i-- {
+		res := domain.PostsResponse{
+			ID:      reqs[i].ID,
+			Records: map[int32][]domain.Post{reqs[i].Threads[0]: {{ID: reqs[i].Threads[0] * 10}}},
+		}
+		if i == 1 {
+			res.Packed, res.Records = res.Records, nil
+		}
+		require.NoError(t, enc.Encode(res))
+	}
+
+	res, err := first()
+	require.NoError(t, err)
+	assert.Equal(t, map[int32][]domain.Post{1: {{ID: 10}}}, res)
+	res, err = second()
+	require.NoError(t, err)
+	assert.Equal(t, map[int32][]domain.Post{2: {{ID: 20, ThreadID: 2}}}, res, `packed posts are listed under their thread`)
+	assert.False(t, c.Broken())
+}
+
+func TestClientStream(t *testing.T) {
+	server, conn := net.Pipe()
+	c := gobClient(conn, decodeThreads)
+	defer conn.Close()
+
+	go func() {
+		var req domain.ThreadsRequest
+		gob.NewDecoder(server).Decode(&req)
+		enc := gob.NewEncoder(server)
+		enc.Encode(domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1}, {ID: 2}}, More: true})
+		enc.Encode(domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 3}, {ID: 4}}, More: true})
+		enc.Encode(domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 5}}, Duration: time.Second})
+	}()
+	var chunks [][]domain.Thread
+	res, err := c.threads(context.Background(), domain.ThreadsRequest{Limit: 5, Chunk: 2}, func(threads []domain.Thread) {
+		chunks = append(chunks, threads)
+	})()
+	require.NoError(t, err)
+	assert.Equal(t, [][]domain.Thread{{{ID: 1}, {ID: 2}}, {{ID: 3}, {ID: 4}}, {{ID: 5}}}, chunks)
+	assert.Equal(t, []domain.Thread{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}}, res.Threads)
+	assert.Equal(t, time.Second, res.Duration, `the last frame carries the summary`)
+	assert.False(t, c.Busy())
+}
+
+func TestClientStreamLimit(t *testing.T) {
+	server, conn := net.Pipe()
+	c := gobClient(conn, decodeThreads)
+	defer conn.Close()
+
+	reqs := make(chan domain.ThreadsRequest, 1)
+	go func() {
+		var req domain.ThreadsRequest
+		gob.NewDecoder(server).Decode(&req)
+		reqs <- req
+		gob.NewEncoder(server).Encode(domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1}}})
+	}()
+	res, err := c.threads(context.Background(), domain.ThreadsRequest{Limit: math.MaxInt32, Chunk: 1}, nil)()
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Thread{{ID: 1}}, res.Threads)
+	assert.Zero(t, (<-reqs).Chunk, `too many frames to buffer: sent in one`)
+}
+
+func TestClientBroken(t *testing.T) {
+	server, conn := net.Pipe()
+	c := gobClient(conn, decodeThreads)
+
+	go func() {
+		var req domain.ThreadsRequest
+		gob.NewDecoder(server).Decode(&req)
+		server.Close()
+	}()
+	wait := c.threads(context.Background(), domain.ThreadsRequest{Limit: 1}, nil)
+
+	_, err := wait()
+	assert.ErrorContains(t, err, `decode`)
+	assert.True(t, c.Broken())
+
+	_, err = c.threads(context.Background(), domain.ThreadsRequest{Limit: 1}, nil)()
+	assert.Error(t, err, `later calls fail fast`)
+}
+
+func TestClientDeadline(t *testing.T) {
+	server, conn := net.Pipe()
+	c := gobClient(conn, decodePosts)
+	defer conn.Close()
+
+	got := make(chan domain.PostsRequest, 1)
+	go func() {
+		var req domain.PostsRequest
+		gob.NewDecoder(server).Decode(&req)
+		got <- req // and never answer
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := c.postsBatch(ctx, 1, nil, []int32{1}, nil)()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	req := <-got
+	timeout, err := time.ParseDuration(req.Headers[domain.HeaderTimeout])
+	require.NoError(t, err)
+	assert.InDelta(t, 20*time.Millisecond, timeout, float64(10*time.Millisecond))
+
+	// the hung connection is not handed out again
+	assert.Eventually(t, c.Broken, time.Second, time.Millisecond)
+}
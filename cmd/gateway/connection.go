@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/graphql-go/graphql"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+// connection is a page of a Relay style connection (https://relay.dev/graphql/connections.htm).
+type connection[T any] struct {
+	Edges    []edge[T]
+	PageInfo pageInfo
+}
+
+type edge[T any] struct {
+	Cursor string
+	Node   T
+}
+
+type pageInfo struct {
+	HasNextPage bool
+	EndCursor   *string // nil for an empty page
+}
+
+// newConnection pages records, which were fetched with a limit of first+1 so one extra means there is a next page.
+func newConnection[T any](records []T, first int, cursor func(T) domain.Cursor) connection[T] {
+	var c connection[T]
+	if len(records) > first {
+		c.PageInfo.HasNextPage = true
+		records = records[:first]
+	}
+	c.Edges = make([]edge[T], len(records))
+	for i, record := range records {
+		c.Edges[i] = edge[T]{Cursor: cursor(record).String(), Node: record}
+	}
+	if len(c.Edges) > 0 {
+		c.PageInfo.EndCursor = &c.Edges[len(c.Edges)-1].Cursor
+	}
+	return c
+}
+
+func threadCursor(t domain.Thread) domain.Cursor { return domain.NewCursor(t.Created, t.ID) }
+func postCursor(p domain.Post) domain.Cursor     { return domain.NewCursor(p.Created, p.ID) }
+
+func threadID(t domain.Thread) int32           { return t.ID }
+func edgeThreadID(e edge[domain.Thread]) int32 { return e.Node.ID }
+
+// page reads the first and after connection arguments.
+func page(args map[string]any) (int, *domain.Cursor, error) {
+	first, ok := args[`first`].(int)
+	if !ok {
+		return 0, nil, &domain.Error{Code: domain.CodeInvalidArgument, Message: `first is required`}
+	}
+	if first < 0 {
+		return 0, nil, &domain.Error{
+			Code:    domain.CodeInvalidArgument,
+			Message: fmt.Sprintf(`first must be non-negative, got %d`, first),
+		}
+	}
+	if first >= math.MaxInt32 { // one more is fetched to tell whether there is a next page
+		return 0, nil, &domain.Error{
+			Code:    domain.CodeInvalidArgument,
+			Message: fmt.Sprintf(`first must be below %d, got %d`, math.MaxInt32, first),
+		}
+	}
+	raw, ok := args[`after`].(string)
+	if !ok {
+		return first, nil, nil
+	}
+	after, err := domain.ParseCursor(raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	return first, &after, nil
+}
+
+var (
+	PageArgs = graphql.FieldConfigArgument{
+		`first`: &graphql.ArgumentConfig{
+			Type:         graphql.Int,
+			DefaultValue: 10,
+		},
+		`after`: &graphql.ArgumentConfig{
+			Type: graphql.String,
+		},
+	}
+	PageInfo = graphql.NewObject(graphql.ObjectConfig{
+		Name: `PageInfo`,
+		Fields: graphql.Fields{
+			`hasNextPage`: &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			`endCursor`:   &graphql.Field{Type: graphql.String},
+		},
+	})
+)
+
+// connectionType describes connections to node, named after it.
+func connectionType(node *graphql.Object) *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: node.Name() + `Connection`,
+		Fields: graphql.Fields{
+			`edges`: &graphql.Field{
+				Type: graphql.NewList(graphql.NewObject(graphql.ObjectConfig{
+					Name: node.Name() + `Edge`,
+					Fields: graphql.Fields{
+						`cursor`: &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+						`node`:   &graphql.Field{Type: node},
+					},
+				})),
+			},
+			`pageInfo`: &graphql.Field{Type: graphql.NewNonNull(PageInfo)},
+		},
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+// serviceError is a failed call to a domain service, surfaced to GraphQL clients via extensions.
+type serviceError struct {
+	service string
+	code    string
+	message string
+	threads []int32 // posts only: the threads that could not be loaded
+}
+
+func newServiceError(service string, err error, threads []int32) *serviceError {
+	se := &serviceError{
+		service: service,
+		code:    domain.CodeUnavailable,
+		message: err.Error(),
+		threads: threads,
+	}
+	var derr *domain.Error
+	if errors.As(err, &derr) {
+		se.code = derr.Code
+		se.message = derr.Message
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		se.code = domain.CodeDeadlineExceeded
+	}
+	return se
+}
+
+func (e *serviceError) Error() string {
+	return e.service + `: ` + e.message
+}
+
+func (e *serviceError) Extensions() map[string]any {
+	ext := map[string]any{
+		`code`:    e.code,
+		`service`: e.service,
+	}
+	if e.threads != nil {
+		ext[`threads`] = e.threads
+	}
+	return ext
+}
+
+// formatError digs through the wrapping graphql-go applies to resolver (and thunk) errors so
+// extensions from a serviceError make it into the response.
+func formatError(err error) gqlerrors.FormattedError {
+	formatted := gqlerrors.FormatError(err)
+	for cause := err; cause != nil; {
+		if ext, ok := cause.(gqlerrors.ExtendedError); ok {
+			formatted.Extensions = ext.Extensions()
+			break
+		}
+		switch e := cause.(type) {
+		case *gqlerrors.Error:
+			cause = e.OriginalError
+		case gqlerrors.FormattedError:
+			cause = e.OriginalError()
+		default:
+			cause = errors.Unwrap(cause)
+		}
+	}
+	return formatted
+}
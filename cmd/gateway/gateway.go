@@ -2,190 +2,336 @@ package main
 
 import (
 	"context"
-	"encoding/gob"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"net/http"
 	_ "net/http/pprof"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	dataloader "github.com/graph-gophers/dataloader/v7"
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/handler"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/propagation"
 
 	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
 	"github.com/bign8/supergraph-top-n-challenge/lib/env"
+	"github.com/bign8/supergraph-top-n-challenge/lib/graceful"
+	"github.com/bign8/supergraph-top-n-challenge/lib/health"
+	"github.com/bign8/supergraph-top-n-challenge/lib/metrics"
 	"github.com/bign8/supergraph-top-n-challenge/lib/tracing"
+	"github.com/bign8/supergraph-top-n-challenge/lib/wire"
 )
 
-type Identified struct {
-	ID int32 `json:"id"`
-}
-
 func resolveThreads(p graphql.ResolveParams) (any, error) {
-	ctx, span := otel.Tracer(``).Start(p.Context, `resolveThreads`)
-	defer span.End()
+	limit, ok := p.Args[`limit`].(int)
+	if !ok {
+		return nil, newServiceError(`gateway`, &domain.Error{Code: domain.CodeInvalidArgument, Message: `limit is required`}, nil)
+	}
+	planned, ok := planPosts(p.Info)
+	var onChunk func([]domain.Thread)
+	if planning && ok { // posts are requested chunk by chunk, as the threads arrive
+		onChunk = func(threads []domain.Thread) { prefetchPosts(p.Context, planned, threads) }
+	}
+	res, err := fetchThreads(p.Context, int32(limit), project(p.Info, threadColumns), nil, onChunk)
+	if err != nil {
+		return nil, err
+	}
+	if onChunk == nil {
+		expectPosts(p.Context, res.Threads, threadID, postsKeys(p.Info))
+	}
+	return res.Threads, nil
+}
 
-	limit := p.Args[`limit`].(int)
-	span.SetAttributes(attribute.Int(`limit`, limit))
+func resolveThreadsConnection(p graphql.ResolveParams) (any, error) {
+	first, after, err := page(p.Args)
+	if err != nil {
+		return nil, newServiceError(`gateway`, err, nil)
+	}
+	// cursors are built from created, whether or not it was selected
+	fields := union(project(p.Info, threadColumns, `edges`, `node`), domain.FieldCreated)
+	res, err := fetchThreads(p.Context, int32(first+1), fields, after, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn := newConnection(res.Threads, first, threadCursor)
+	expectPosts(p.Context, conn.Edges, edgeThreadID, postsKeys(p.Info, `edges`, `node`))
+	return conn, nil
+}
 
-	c := threadsPool.Get().(*client)
-	defer threadsPool.Put(c)
+// fetchThreads requests threads, streamed in chunks of threadsChunk (if set) that are passed to onChunk (if set)
+// as they arrive.
+func fetchThreads(ctx context.Context, limit int32, fields []string, after *domain.Cursor, onChunk func([]domain.Thread)) (domain.ThreadsResponse, error) {
+	ctx, span := otel.Tracer(``).Start(ctx, `resolveThreads`)
+	defer span.End()
+	span.SetAttributes(attribute.Int(`limit`, int(limit)), attribute.StringSlice(`fields`, fields))
+	if limit < 0 {
+		return domain.ThreadsResponse{}, newServiceError(`gateway`, &domain.Error{
+			Code:    domain.CodeInvalidArgument,
+			Message: fmt.Sprintf(`limit must be non-negative, got %d`, limit),
+		}, nil)
+	}
 
-	res, err := c.threads(ctx, int32(limit))
+	wait := services.threads(ctx, domain.ThreadsRequest{
+		Limit:  limit,
+		Fields: fields,
+		After:  after,
+		Chunk:  threadsChunk,
+	}, onChunk)
+	res, err := wait()
 	if err != nil {
 		span.RecordError(err)
-		return nil, fmt.Errorf(`client.Threads: %w`, err)
+		return res, newServiceError(`threads`, err, nil)
 	}
 
-	// convert to model
-	output := make([]Identified, limit)
-	for i, id := range res {
-		output[i].ID = id
-	}
-	return output, nil
+	span.SetAttributes(attribute.Int64(`threads.duration_us`, res.Duration.Microseconds()))
+	return res, nil
 }
 
-type client struct {
-	conn io.Closer
-	enc  *gob.Encoder
-	dec  *gob.Decoder
-}
+func resolvePostsBatch(p graphql.ResolveParams) (any, error) {
+	req, err := postsRequest(p.Args, p.Info)
+	if err != nil {
+		return nil, newServiceError(`gateway`, err, nil)
+	}
+	req.Thread = p.Source.(domain.Thread).ID
+	thunk, ok := prefetched(p.Context, req)
+	if !ok {
+		thunk = loaderFor(p.Context, req).Load(p.Context, req)
+	}
 
-type PostRequest struct {
-	Limit  int32
-	Thread int32
+	return func() (any, error) {
+		_, span := otel.Tracer(``).Start(p.Context, `resolvePostsBatchThunk`)
+		defer span.End()
+		return thunk()
+	}, nil
 }
 
-func (c client) postsBatch(ctx context.Context, limit int32, threads []int32) (map[int32][]int32, error) {
-	req := domain.PostsRequest{
-		Limit:   limit,
-		Threads: threads,
-		Headers: make(map[string]string, 2),
-	}
-	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(req.Headers))
-	if err := c.enc.Encode(req); err != nil {
-		return nil, fmt.Errorf(`encode: %w`, err)
+// postsRequest is the key resolvePostsBatch loads, Thread aside.
+func postsRequest(args map[string]any, info graphql.ResolveInfo) (PostRequest, error) {
+	limit, ok := args[`limit`].(int)
+	if !ok {
+		return PostRequest{}, &domain.Error{Code: domain.CodeInvalidArgument, Message: `limit is required`}
 	}
-	var res domain.PostsResponse
-	if err := c.dec.Decode(&res); err != nil {
-		return nil, fmt.Errorf(`decode: %w`, err)
+	if limit < 0 { // checked here too as batches trim to each key's limit
+		return PostRequest{}, &domain.Error{
+			Code:    domain.CodeInvalidArgument,
+			Message: fmt.Sprintf(`limit must be non-negative, got %d`, limit),
+		}
 	}
-	return res.Posts, nil
+	return PostRequest{
+		Limit:  int32(limit),
+		Fields: strings.Join(project(info, postColumns), `,`),
+	}, nil
 }
 
-func (c client) threads(ctx context.Context, limit int32) ([]int32, error) {
-	request := &domain.ThreadsRequest{
-		Limit:   int32(limit),
-		Headers: make(map[string]string, 2),
+func resolvePostsConnection(p graphql.ResolveParams) (any, error) {
+	req, first, err := postsConnectionRequest(p.Args, p.Info)
+	if err != nil {
+		return nil, newServiceError(`gateway`, err, nil)
 	}
+	req.Thread = p.Source.(domain.Thread).ID
+	thunk := loaderFor(p.Context, req).Load(p.Context, req)
 
-	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(request.Headers))
+	return func() (any, error) {
+		posts, err := thunk()
+		if err != nil {
+			return nil, err
+		}
+		return newConnection(posts, first, postCursor), nil
+	}, nil
+}
 
-	// make request
-	if err := c.enc.Encode(request); err != nil {
-		return nil, fmt.Errorf(`gob encode: %w`, err)
+// postsConnectionRequest is the key resolvePostsConnection loads, Thread aside, for a page of first posts.
+func postsConnectionRequest(args map[string]any, info graphql.ResolveInfo) (PostRequest, int, error) {
+	first, after, err := page(args)
+	if err != nil {
+		return PostRequest{}, 0, err
 	}
-
-	// process response
-	var res []int32
-	if err := c.dec.Decode(&res); err != nil {
-		return nil, fmt.Errorf(`gob decode: %w`, err)
+	req := PostRequest{
+		Limit:  int32(first + 1),
+		Fields: strings.Join(union(project(info, postColumns, `edges`, `node`), domain.FieldCreated), `,`),
 	}
-	return res, nil
+	if after != nil {
+		req.After = after.String()
+	}
+	return req, first, nil
 }
 
-var postsPool = sync.Pool{
-	New: func() any {
-		conn, err := net.Dial(`tcp`, env.Default(`POSTS_HOST`, `[::]:8001`))
-		if err != nil {
-			panic(err)
-		}
-		log.Printf(`New connection to posts: %v`, conn.LocalAddr())
+// threadColumns and postColumns map GraphQL fields to the domain fields that back them.
+// Fields that are always returned (id, threadId) or resolved elsewhere (posts) are absent.
+var (
+	threadColumns = map[string]string{`created`: domain.FieldCreated}
+	postColumns   = map[string]string{`created`: domain.FieldCreated}
+)
 
-		c := &client{
-			conn: conn,
-			enc:  gob.NewEncoder(conn),
-			dec:  gob.NewDecoder(conn),
+// visit calls fn with every field selected on the field being resolved (or on its descendants along path,
+// e.g. a connection's edges.node), looking through fragments.
+func visit(info graphql.ResolveInfo, fn func(*ast.Field), path ...string) {
+	var walk func(set *ast.SelectionSet, depth int)
+	walk = func(set *ast.SelectionSet, depth int) {
+		if set == nil {
+			return
+		}
+		for _, sel := range set.Selections {
+			switch sel := sel.(type) {
+			case *ast.Field:
+				if depth == len(path) {
+					fn(sel)
+				} else if sel.Name.Value == path[depth] {
+					walk(sel.SelectionSet, depth+1)
+				}
+			case *ast.InlineFragment:
+				walk(sel.SelectionSet, depth)
+			case *ast.FragmentSpread:
+				if frag, ok := info.Fragments[sel.Name.Value].(*ast.FragmentDefinition); ok {
+					walk(frag.SelectionSet, depth)
+				}
+			}
 		}
-		// runtime.SetFinalizer(c, c.conn.Close)
+	}
+	for _, field := range info.FieldASTs {
+		walk(field.SelectionSet, 0)
+	}
+}
 
-		return c
-	},
+// project lists the domain fields backing the selected fields (see visit).
+func project(info graphql.ResolveInfo, columns map[string]string, path ...string) []string {
+	var fields []string
+	visit(info, func(f *ast.Field) {
+		if field, ok := columns[f.Name.Value]; ok {
+			fields = append(fields, field)
+		}
+	}, path...)
+	return union(fields)
 }
 
-var threadsPool = sync.Pool{
-	New: func() any {
-		conn, err := net.Dial(`tcp`, env.Default(`THREADS_HOST`, `[::]:8002`))
-		if err != nil {
-			panic(err)
+// postsFields load posts per thread, each resolving one PostRequest.
+var postsFields = map[string]bool{`posts`: true, `postsConnection`: true}
+
+// postsKeys lists the distinct keys, Thread aside, the posts fields selected on a thread (see visit) load:
+// aliases asking for the same posts share a key (the loader caches it), and invalid ones load nothing.
+func postsKeys(info graphql.ResolveInfo, path ...string) []PostRequest {
+	aliases := make(map[string][]*ast.Field)
+	visit(info, func(f *ast.Field) {
+		if postsFields[f.Name.Value] {
+			alias := f.Name.Value
+			if f.Alias != nil {
+				alias = f.Alias.Value
+			}
+			aliases[alias] = append(aliases[alias], f)
 		}
-		log.Printf(`New connection to threads: %v`, conn.LocalAddr())
-		return &client{
-			conn: conn,
-			enc:  gob.NewEncoder(conn),
-			dec:  gob.NewDecoder(conn),
+	}, path...)
+	var keys []PostRequest
+	seen := make(map[PostRequest]bool, len(aliases))
+	for _, fields := range aliases {
+		field := info // as the resolver of the alias sees it
+		field.FieldASTs = fields
+		args := arguments(info, Thread.Fields()[fields[0].Name.Value], fields[0])
+		var req PostRequest
+		var err error
+		if fields[0].Name.Value == `posts` {
+			req, err = postsRequest(args, field)
+		} else {
+			req, _, err = postsConnectionRequest(args, field)
 		}
-	},
+		if err == nil && !seen[req] {
+			seen[req] = true
+			keys = append(keys, req)
+		}
+	}
+	return keys
 }
 
-func resolvePostsBatch(p graphql.ResolveParams) (any, error) {
-	limit := p.Args[`limit`].(int)
-	thread := p.Source.(Identified)
-
-	thunk := loader.Load(p.Context, PostRequest{
-		Limit:  int32(limit),
-		Thread: thread.ID,
-	})
+// arguments reads the arguments of f, a field defined by def, given as literals or variables, else defaulted.
+func arguments(info graphql.ResolveInfo, def *graphql.FieldDefinition, f *ast.Field) map[string]any {
+	args := make(map[string]any, len(def.Args))
+	for _, arg := range def.Args {
+		if arg.DefaultValue != nil {
+			args[arg.Name()] = arg.DefaultValue
+		}
+	}
+	for _, arg := range f.Arguments {
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			if n, err := strconv.Atoi(v.Value); err == nil {
+				args[arg.Name.Value] = n
+			}
+		case *ast.StringValue:
+			args[arg.Name.Value] = v.Value
+		case *ast.Variable:
+			if value, ok := info.VariableValues[v.Name.Value]; ok && value != nil {
+				args[arg.Name.Value] = value
+			}
+		}
+	}
+	return args
+}
 
-	return func() (any, error) {
-		_, span := otel.Tracer(``).Start(p.Context, `resolvePostsBatchThunk`)
-		defer span.End()
-		posts, err := thunk()
-		out := make([]Identified, len(posts))
-		for i, postID := range posts {
-			out[i].ID = postID
+// union returns the sorted, distinct fields of fields and more.
+func union(fields []string, more ...string) []string {
+	all := append(append([]string(nil), fields...), more...)
+	sort.Strings(all)
+	out := all[:0]
+	for i, field := range all {
+		if i == 0 || field != all[i-1] {
+			out = append(out, field)
 		}
-		return out, err
-	}, nil
+	}
+	return out
 }
 
 var (
-	ID    = &graphql.Field{Type: graphql.Int}
-	Limit = graphql.FieldConfigArgument{
+	ID      = &graphql.Field{Type: graphql.Int}
+	Created = &graphql.Field{Type: graphql.DateTime}
+	Limit   = graphql.FieldConfigArgument{
 		`limit`: &graphql.ArgumentConfig{
 			Type: graphql.Int,
 		},
 	}
+	Post = graphql.NewObject(graphql.ObjectConfig{
+		Name: `Post`,
+		Fields: graphql.Fields{
+			`id`:       ID,
+			`threadId`: &graphql.Field{Type: graphql.Int},
+			`created`:  Created,
+		},
+	})
+	Thread = graphql.NewObject(graphql.ObjectConfig{
+		Name: `Thread`,
+		Fields: graphql.Fields{
+			`id`:      ID,
+			`created`: Created,
+			`posts`: &graphql.Field{
+				Type:    graphql.NewList(Post),
+				Args:    Limit,
+				Resolve: resolvePostsBatch,
+			},
+			`postsConnection`: &graphql.Field{
+				Type:    connectionType(Post),
+				Args:    PageArgs,
+				Resolve: resolvePostsConnection,
+			},
+		},
+	})
 	schema = graphql.SchemaConfig{
 		Query: graphql.NewObject(graphql.ObjectConfig{
 			Name: `RootQuery`,
 			Fields: graphql.Fields{
 				`threads`: &graphql.Field{
-					Type: graphql.NewList(graphql.NewObject(graphql.ObjectConfig{
-						Name: `Thread`,
-						Fields: graphql.Fields{
-							`id`: ID,
-							`posts`: &graphql.Field{
-								Type: graphql.NewList(graphql.NewObject(graphql.ObjectConfig{
-									Name:   `Post`,
-									Fields: graphql.Fields{`id`: ID},
-								})),
-								Args:    Limit,
-								Resolve: resolvePostsBatch,
-							},
-						},
-					})),
+					Type:    graphql.NewList(Thread),
 					Args:    Limit,
 					Resolve: resolveThreads,
 				},
+				`threadsConnection`: &graphql.Field{
+					Type:    connectionType(Thread),
+					Args:    PageArgs,
+					Resolve: resolveThreadsConnection,
+				},
 			},
 		}),
 	}
@@ -199,11 +345,29 @@ func check(err error) {
 
 type tracer struct{}
 
+// operations are the operation names labelling metrics.Requests as is; clients pick the names, so any other
+// is counted as `other` to keep the label's values bounded.
+var operations = map[string]bool{`MagicSauce`: true} // k6-test/tests/graphql.js
+
+// operation is the metrics.Requests label of the operation named name.
+func operation(name string) string {
+	switch {
+	case name == ``:
+		return `anonymous`
+	case operations[name]:
+		return name
+	default:
+		return `other`
+	}
+}
+
 func (t tracer) TraceQuery(ctx context.Context, queryString, operationName string) (context.Context, graphql.TraceQueryFinishFunc) {
 	ctx, span := otel.Tracer(``).Start(ctx, operationName)
+	start := time.Now()
 	return ctx, func(fe []gqlerrors.FormattedError) {
 		// TODO: span errors
 		span.End()
+		metrics.Requests.WithLabelValues(operation(operationName)).Observe(time.Since(start).Seconds())
 	}
 }
 
@@ -218,72 +382,84 @@ func (t tracer) TraceField(ctx context.Context, fieldName, typeName string) (con
 	}
 }
 
-func loadBatch(ctx context.Context, keys []PostRequest) []*dataloader.Result[[]int32] {
-
-	ctx, span := otel.Tracer(``).Start(ctx, `loadBatch`)
-	defer span.End()
-
-	limit := keys[0].Limit
-	threads := make([]int32, len(keys))
-	for i, req := range keys {
-		if req.Limit != limit {
-			panic(`non-equal limits!`)
-		}
-		threads[i] = req.Thread
-	}
-	res := make([]*dataloader.Result[[]int32], len(keys))
-
-	conn := postsPool.Get().(*client)
-	defer postsPool.Put(conn)
-
-	data, err := conn.postsBatch(ctx, limit, threads)
-	if err != nil {
-		for i := range res {
-			res[i] = &dataloader.Result[[]int32]{Error: err}
-		}
-		return res
-	}
-
-	for i, req := range keys {
-		res[i] = &dataloader.Result[[]int32]{
-			Data: data[req.Thread],
-		}
-	}
-
-	return res
-}
-
-var loader = dataloader.NewBatchedLoader(
-	loadBatch,
-	dataloader.WithWait[PostRequest, []int32](100*time.Nanosecond), // this should be bucket size based on threads response
-	// dataloader.WithBatchCapacity[PostRequest, []int32](10),
-	dataloader.WithClearCacheOnBatch[PostRequest, []int32](), // clearing batches in good faith
-	// dataloader.WithTracer[PostRequest, []int32](t),
-	// TODO dataloader.WithTracer(t))
-)
-
 func main() {
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
-	tracing.Init(`gateway`)
+	flush, err := tracing.Init(`gateway`)
+	var settings *tracing.SettingsError
+	if errors.As(err, &settings) {
+		check(err) // rather than run with telemetry other than configured
+	} else if err != nil {
+		log.Printf(`running without telemetry: %v`, err)
+	}
+	signaled, stop := graceful.Signal()
+	defer stop()
+	codec, err = wire.Lookup(env.Default(`WIRE_CODEC`, codec.Name()))
+	check(err)
+	check(initBackend(env.Default(`TRANSPORT`, `gob`)))
 	schema, err := graphql.NewSchema(schema)
 	check(err)
 
 	h := handler.New(&handler.Config{
-		Schema:     &schema,
-		Playground: true,
-		Tracer:     &tracer{},
+		Schema:        &schema,
+		Playground:    true,
+		Tracer:        &tracer{},
+		FormatErrorFn: formatError,
 	})
-	mux := http.DefaultServeMux
-	mux.Handle(`/graphql`, h)
+	api, err := scoped(h, env.Default(`LOADER_SCOPE`, `request`))
+	check(err)
+	batchWait, err = time.ParseDuration(env.Default(`LOADER_MAX_WAIT`, batchWait.String()))
+	check(err)
+	planning = env.Default(`QUERY_PLANNER`, `off`) == `on`
+	chunk, err := strconv.ParseInt(env.Default(`THREADS_CHUNK`, `0`), 10, 32)
+	check(err)
+	threadsChunk = int32(chunk)
+	timeout, err := time.ParseDuration(env.Default(`REQUEST_TIMEOUT`, `5s`))
+	check(err)
+	mux := http.DefaultServeMux // also serves net/http/pprof, whose profiles outlast timeout
+	mux.Handle(`/graphql`, bounded(api, timeout))
 	mux.Handle(`/`, http.RedirectHandler(`/graphql`, http.StatusSeeOther))
+	checks := services.checks()
+	checks[`serving`] = health.Until(signaled)
+	health.Register(mux, checks)
+	metrics.Register(mux)
 	server := http.Server{
 		Addr:    `[::]:8000`,
 		Handler: measure(mux),
 	}
+	shutdownTimeout, err := time.ParseDuration(env.Default(`SHUTDOWN_TIMEOUT`, `8s`))
+	check(err)
 	log.Printf(`gateway on %v`, server.Addr)
-	check(server.ListenAndServe())
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			check(err)
+		}
+	}()
+
+	<-signaled.Done()
+	log.Printf(`shutting down (waiting up to %v)`, shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf(`draining: %v`, err)
+	}
+	if err := services.Close(); err != nil { // after draining, as pooled connections carry in-flight responses
+		log.Printf(`closing backends: %v`, err)
+	}
+	if err := flush(ctx); err != nil {
+		log.Printf(`flushing telemetry: %v`, err)
+	}
+}
+
+// bounded cancels requests after timeout, so a hung backend can't hang the gateway.
+func bounded(h http.Handler, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}
 }
 
+// measure traces and logs every request.
 func measure(h http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -0,0 +1,899 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dataloader "github.com/graph-gophers/dataloader/v7"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/handler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+	"github.com/bign8/supergraph-top-n-challenge/lib/health"
+	"github.com/bign8/supergraph-top-n-challenge/lib/pool"
+	"github.com/bign8/supergraph-top-n-challenge/lib/rpc"
+	"github.com/bign8/supergraph-top-n-challenge/lib/wire"
+)
+
+// fake is an in-process stand-in for a domain service speaking gob over TCP.
+type fake[Req, Res any] struct {
+	mu     sync.Mutex
+	handle func(req Req, emit func(Res) error) Res
+}
+
+func (f *fake[Req, Res]) set(handle func(Req) Res) {
+	f.stream(func(req Req, _ func(Res) error) Res { return handle(req) })
+}
+
+// stream sets a handler that may emit responses before returning the last one.
+func (f *fake[Req, Res]) stream(handle func(req Req, emit func(Res) error) Res) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handle = handle
+}
+
+func (f *fake[Req, Res]) serve(req Req, emit func(Res) error) Res {
+	f.mu.Lock()
+	handle := f.handle
+	f.mu.Unlock()
+	return handle(req, emit)
+}
+
+func (f *fake[Req, Res]) listen() string {
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, enc, dec, err := wire.Accept(conn)
+				if err != nil {
+					return
+				}
+				for {
+					var req Req
+					if err := dec.Decode(&req); err != nil {
+						return
+					}
+					emit := func(res Res) error { return enc.Encode(res) }
+					if err := enc.Encode(f.serve(req, emit)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+var (
+	fakeThreads fake[domain.ThreadsRequest, domain.ThreadsResponse]
+	fakePosts   fake[domain.PostsRequest, domain.PostsResponse]
+)
+
+// fakeRPC serves the fakes over gRPC.
+type fakeRPC struct{}
+
+func (fakeRPC) List(req *domain.ThreadsRequest, stream rpc.ThreadsStream) error {
+	last := fakeThreads.serve(*req, func(res domain.ThreadsResponse) error { return stream.Send(&res) })
+	return stream.Send(&last)
+}
+
+func (fakeRPC) Batch(ctx context.Context, req *domain.PostsRequest) (*domain.PostsResponse, error) {
+	res := fakePosts.serve(*req, nil)
+	return &res, nil
+}
+
+func listenRPC() string {
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := rpc.NewServer()
+	rpc.RegisterThreads(s, fakeRPC{})
+	rpc.RegisterPosts(s, fakeRPC{})
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+// backends by TRANSPORT; tests run over gob unless they say otherwise
+var backends = make(map[string]backend)
+
+func TestMain(m *testing.M) {
+	os.Setenv(`THREADS_HOST`, fakeThreads.listen())
+	os.Setenv(`POSTS_HOST`, fakePosts.listen())
+	rpcHost := listenRPC()
+	os.Setenv(`THREADS_GRPC_HOST`, rpcHost)
+	os.Setenv(`POSTS_GRPC_HOST`, rpcHost)
+	for _, transport := range []string{`grpc`, `gob`} {
+		if err := initBackend(transport); err != nil {
+			log.Fatal(err)
+		}
+		backends[transport] = services
+	}
+	os.Exit(m.Run())
+}
+
+// execute runs query against the gateway schema, formatting errors the same way the handler does.
+func execute(t testing.TB, query string) string {
+	s, err := graphql.NewSchema(schema)
+	require.NoError(t, err)
+	res := graphql.Do(graphql.Params{
+		Schema:        s,
+		RequestString: query,
+		Context:       withLoaders(context.Background()),
+	})
+	for i, err := range res.Errors {
+		res.Errors[i] = formatError(err.OriginalError())
+	}
+	out, err := json.Marshal(res)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestServiceErrors(t *testing.T) {
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		return domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1}, {ID: 2}}[:req.Limit]}
+	})
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		return domain.PostsResponse{ID: req.ID, Error: &domain.Error{Code: domain.CodeInternal, Message: `query: bad connection`}}
+	})
+
+	out := execute(t, `{ threads(limit: 2) { id posts(limit: 1) { id } } }`)
+	assert.JSONEq(t, `{
+		"data": {"threads": [{"id": 1, "posts": null}, {"id": 2, "posts": null}]},
+		"errors": [{
+			"message": "posts: query: bad connection",
+			"locations": [{"line": 1, "column": 26}],
+			"path": ["threads", 0, "posts"],
+			"extensions": {"code": "INTERNAL", "service": "posts", "threads": [1, 2]}
+		}, {
+			"message": "posts: query: bad connection",
+			"locations": [{"line": 1, "column": 26}],
+			"path": ["threads", 1, "posts"],
+			"extensions": {"code": "INTERNAL", "service": "posts", "threads": [1, 2]}
+		}]
+	}`, out)
+
+	// the same pooled connections keep working after a failed request
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		return domain.ThreadsResponse{ID: req.ID, Error: &domain.Error{Code: domain.CodeInvalidArgument, Message: `nope`}}
+	})
+	out = execute(t, `{ threads(limit: 2) { id } }`)
+	assert.JSONEq(t, `{
+		"data": {"threads": null},
+		"errors": [{
+			"message": "threads: nope",
+			"locations": [{"line": 1, "column": 3}],
+			"path": ["threads"],
+			"extensions": {"code": "INVALID_ARGUMENT", "service": "threads"}
+		}]
+	}`, out)
+
+	// resolvers report arguments the schema would not pass rather than panic
+	_, err := resolveThreads(graphql.ResolveParams{Context: context.Background(), Args: map[string]any{`limit`: `2`}})
+	var serr *serviceError
+	require.ErrorAs(t, err, &serr)
+	assert.Equal(t, domain.CodeInvalidArgument, serr.code)
+	_, _, err = page(map[string]any{`first`: `2`})
+	var derr *domain.Error
+	require.ErrorAs(t, err, &derr)
+	assert.Equal(t, domain.CodeInvalidArgument, derr.Code)
+}
+
+func TestThreadsEnvelope(t *testing.T) {
+	var version int32
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		version = req.Version
+		return domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 3}, {ID: 2}, {ID: 1}}, Duration: time.Millisecond}
+	})
+
+	out := execute(t, `{ threads(limit: 3) { id } }`)
+	assert.JSONEq(t, `{"data": {"threads": [{"id": 3}, {"id": 2}, {"id": 1}]}}`, out)
+	assert.Equal(t, int32(domain.ThreadsVersion), version)
+
+	version = -1
+	out = execute(t, `{ threads(limit: -1) { id } }`)
+	assert.Contains(t, out, `limit must be non-negative, got -1`)
+	assert.Equal(t, int32(-1), version, `rejected before sending`)
+}
+
+func TestProjection(t *testing.T) {
+	created := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	var threadsReq domain.ThreadsRequest
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		threadsReq = req
+		threads := []domain.Thread{{ID: 1}}
+		if len(req.Fields) > 0 {
+			threads[0].Created = created
+		}
+		return domain.ThreadsResponse{ID: req.ID, Threads: threads}
+	})
+	var postsReq domain.PostsRequest
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		postsReq = req
+		posts := []domain.Post{{ID: 10, ThreadID: 1}}
+		if len(req.Fields) > 0 {
+			posts[0].Created = created.Add(time.Hour)
+		}
+		return domain.PostsResponse{ID: req.ID, Records: map[int32][]domain.Post{1: posts}}
+	})
+
+	out := execute(t, `{ threads(limit: 1) { id created posts(limit: 1) { ...post } } } fragment post on Post { id threadId created }`)
+	assert.JSONEq(t, `{"data": {"threads": [{
+		"id": 1,
+		"created": "2023-04-05T06:07:08Z",
+		"posts": [{"id": 10, "threadId": 1, "created": "2023-04-05T07:07:08Z"}]
+	}]}}`, out)
+	assert.Equal(t, []string{domain.FieldCreated}, threadsReq.Fields)
+	assert.Equal(t, []string{domain.FieldCreated}, postsReq.Fields)
+	assert.Equal(t, int32(domain.PostsPackedVersion), postsReq.Version)
+
+	// unselected columns are not fetched
+	out = execute(t, `{ threads(limit: 1) { id posts(limit: 1) { threadId } } }`)
+	assert.JSONEq(t, `{"data": {"threads": [{"id": 1, "posts": [{"threadId": 1}]}]}}`, out)
+	assert.Empty(t, threadsReq.Fields)
+	assert.Empty(t, postsReq.Fields)
+}
+
+func TestConnections(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	// newest first, with a tie on created broken by id
+	threads := []domain.Thread{{ID: 3, Created: start.Add(2 * time.Hour)}, {ID: 2, Created: start}, {ID: 1, Created: start}}
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		out := threads
+		if req.After != nil {
+			for i, thread := range threads {
+				if domain.NewCursor(thread.Created, thread.ID) == *req.After {
+					out = threads[i+1:]
+				}
+			}
+		}
+		if int(req.Limit) < len(out) {
+			out = out[:req.Limit]
+		}
+		return domain.ThreadsResponse{ID: req.ID, Threads: out}
+	})
+	var postsReqs []domain.PostsRequest
+	var mu sync.Mutex
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		mu.Lock()
+		postsReqs = append(postsReqs, req)
+		mu.Unlock()
+		records := make(map[int32][]domain.Post)
+		for _, thread := range req.Threads {
+			id := thread * 10
+			if after, ok := req.After[thread]; ok {
+				id = after.ID - 1
+			}
+			records[thread] = []domain.Post{{ID: id, ThreadID: thread, Created: start}}
+		}
+		return domain.PostsResponse{ID: req.ID, Records: records}
+	})
+
+	page := func(after string) (ids []int, end string, next bool) {
+		query := `{ threadsConnection(first: 2) { edges { node { id } } pageInfo { hasNextPage endCursor } } }`
+		if after != `` {
+			query = `{ threadsConnection(first: 2, after: "` + after + `") { edges { node { id } } pageInfo { hasNextPage endCursor } } }`
+		}
+		var res struct {
+			Data struct {
+				ThreadsConnection struct {
+					Edges []struct {
+						Node struct{ ID int }
+					}
+					PageInfo struct {
+						HasNextPage bool
+						EndCursor   string
+					}
+				}
+			}
+		}
+		require.NoError(t, json.Unmarshal([]byte(execute(t, query)), &res))
+		for _, edge := range res.Data.ThreadsConnection.Edges {
+			ids = append(ids, edge.Node.ID)
+		}
+		info := res.Data.ThreadsConnection.PageInfo
+		return ids, info.EndCursor, info.HasNextPage
+	}
+	ids, end, next := page(``)
+	assert.Equal(t, []int{3, 2}, ids)
+	assert.True(t, next)
+	ids, _, next = page(end)
+	assert.Equal(t, []int{1}, ids)
+	assert.False(t, next)
+
+	// the same thread at two cursors is split over two posts requests
+	after := domain.NewCursor(start, 30).String()
+	out := execute(t, `{ threads(limit: 1) {
+		a: postsConnection(first: 1) { edges { node { id } } }
+		b: postsConnection(first: 1, after: "`+after+`") { edges { node { id } } }
+	} }`)
+	assert.JSONEq(t, `{"data": {"threads": [{
+		"a": {"edges": [{"node": {"id": 30}}]},
+		"b": {"edges": [{"node": {"id": 29}}]}
+	}]}}`, out)
+	assert.Len(t, postsReqs, 2)
+	for _, req := range postsReqs {
+		assert.Equal(t, int32(2), req.Limit, `first+1 to detect a next page`)
+		assert.Equal(t, []string{domain.FieldCreated}, req.Fields, `needed for cursors`)
+	}
+
+	out = execute(t, `{ threadsConnection(after: "nope") { edges { cursor } } }`)
+	assert.Contains(t, out, `"code":"INVALID_ARGUMENT"`)
+
+	out = execute(t, `{ threadsConnection(first: 2147483647) { edges { cursor } } }`)
+	assert.Contains(t, out, `"code":"INVALID_ARGUMENT"`)
+	assert.Contains(t, out, `first must be below 2147483647`)
+}
+
+func TestMixedLimits(t *testing.T) {
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		return domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1}, {ID: 2}}}
+	})
+	var limits []int32
+	var mu sync.Mutex
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		mu.Lock()
+		limits = append(limits, req.Limit)
+		mu.Unlock()
+		records := make(map[int32][]domain.Post)
+		for _, thread := range req.Threads {
+			for i := int32(0); i < req.Limit; i++ {
+				records[thread] = append(records[thread], domain.Post{ID: thread*10 + i})
+			}
+		}
+		return domain.PostsResponse{ID: req.ID, Records: records}
+	})
+
+	out := execute(t, `{ threads(limit: 2) { id a: posts(limit: 1) { id } b: posts(limit: 3) { id } } }`)
+	assert.JSONEq(t, `{"data": {"threads": [
+		{"id": 1, "a": [{"id": 10}], "b": [{"id": 10}, {"id": 11}, {"id": 12}]},
+		{"id": 2, "a": [{"id": 20}], "b": [{"id": 20}, {"id": 21}, {"id": 22}]}
+	]}}`, out)
+	assert.Equal(t, []int32{3}, limits, `one request at the largest limit`)
+
+	out = execute(t, `{ threads(limit: 2) { a: posts(limit: 1) { id } b: posts(limit: -1) { id } } }`)
+	assert.Contains(t, out, `"code":"INVALID_ARGUMENT"`)
+	assert.Contains(t, out, `"a":[{"id":10}]`)
+}
+
+func TestLoaderScope(t *testing.T) {
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		threads := []domain.Thread{{ID: 1}, {ID: 2}}
+		if req.Limit == 3 {
+			threads = []domain.Thread{{ID: 3}, {ID: 4}, {ID: 5}}
+		}
+		return domain.ThreadsResponse{ID: req.ID, Threads: threads}
+	})
+	var batches [][]int32
+	var mu sync.Mutex
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		threads := append([]int32(nil), req.Threads...)
+		sort.Slice(threads, func(i, j int) bool { return threads[i] < threads[j] })
+		mu.Lock()
+		batches = append(batches, threads)
+		mu.Unlock()
+		return domain.PostsResponse{ID: req.ID, Records: map[int32][]domain.Post{}}
+	})
+	s, err := graphql.NewSchema(schema)
+	require.NoError(t, err)
+	h := handler.New(&handler.Config{Schema: &s, FormatErrorFn: formatError})
+
+	// run serves pairs of requests for 2 and 3 threads concurrently, returning the posts batches
+	run := func(t *testing.T, scope string, pairs int) [][]int32 {
+		api, err := scoped(h, scope)
+		require.NoError(t, err)
+		batches = nil
+		var wg sync.WaitGroup
+		for i := 0; i < pairs; i++ {
+			for _, limit := range []int{2, 3} {
+				wg.Add(1)
+				go func(limit int) {
+					defer wg.Done()
+					body := fmt.Sprintf(`{"query": "{ threads(limit: %d) { posts(limit: 1) { id } } }"}`, limit)
+					r := httptest.NewRequest(http.MethodPost, `/graphql`, strings.NewReader(body))
+					r.Header.Set(`Content-Type`, `application/json`)
+					w := httptest.NewRecorder()
+					api.ServeHTTP(w, r)
+					assert.NotContains(t, w.Body.String(), `"errors"`)
+				}(limit)
+			}
+		}
+		wg.Wait()
+		return batches
+	}
+
+	t.Run(`request`, func(t *testing.T) {
+		counts := make(map[string]int)
+		for _, threads := range run(t, `request`, 20) {
+			counts[fmt.Sprint(threads)]++
+		}
+		assert.Equal(t, map[string]int{`[1 2]`: 20, `[3 4 5]`: 20}, counts, `one batch per request, never mixed`)
+	})
+
+	t.Run(`global`, func(t *testing.T) {
+		defer func(l *dataloader.Loader[PostRequest, []domain.Post], wait time.Duration) {
+			sharedLoader, batchWait = l, wait
+		}(sharedLoader, batchWait)
+		batchWait = time.Minute     // only dispatched once full...
+		sharedLoader = newLoader(5) // ...by the keys of both requests
+		assert.Equal(t, [][]int32{{1, 2, 3, 4, 5}}, run(t, `global`, 1), `batched across requests`)
+	})
+}
+
+// BenchmarkLoaderScope compares request scoped loaders with a loader shared across requests
+// (LOADER_SCOPE=global) and with the planner (QUERY_PLANNER=on) under concurrent load, reporting the
+// p95 latency of the challenge query.
+func BenchmarkLoaderScope(b *testing.B) {
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		threads := make([]domain.Thread, req.Limit)
+		for i := range threads {
+			threads[i].ID = int32(i)
+		}
+		return domain.ThreadsResponse{ID: req.ID, Threads: threads}
+	})
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		time.Sleep(200 * time.Microsecond) // query time
+		records := make(map[int32][]domain.Post, len(req.Threads))
+		for _, thread := range req.Threads {
+			records[thread] = make([]domain.Post, req.Limit)
+		}
+		return domain.PostsResponse{ID: req.ID, Records: records}
+	})
+	s, err := graphql.NewSchema(schema)
+	require.NoError(b, err)
+	h := handler.New(&handler.Config{Schema: &s, FormatErrorFn: formatError})
+	body := `{"query": "{ threads(limit: 4) { id posts(limit: 20) { id } } }"}`
+
+	defer func(on bool) { planning = on }(planning)
+	for _, config := range []struct {
+		name, scope string
+		planning    bool
+	}{
+		{`request`, `request`, false},
+		{`global`, `global`, false},
+		{`planned`, `request`, true},
+	} {
+		b.Run(config.name, func(b *testing.B) {
+			planning = config.planning
+			api, err := scoped(h, config.scope)
+			require.NoError(b, err)
+			var mu sync.Mutex
+			latencies := make([]time.Duration, 0, b.N)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					r := httptest.NewRequest(http.MethodPost, `/graphql`, strings.NewReader(body))
+					r.Header.Set(`Content-Type`, `application/json`)
+					w := httptest.NewRecorder()
+					start := time.Now()
+					api.ServeHTTP(w, r)
+					took := time.Since(start)
+					if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"errors"`) {
+						b.Errorf(`%d: %s`, w.Code, w.Body)
+					}
+					mu.Lock()
+					latencies = append(latencies, took)
+					mu.Unlock()
+				}
+			})
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*95/100].Microseconds()), `p95-µs`)
+		})
+	}
+}
+
+func TestAdaptiveBatch(t *testing.T) {
+	defer func(wait time.Duration) { batchWait = wait }(batchWait)
+	batchWait = time.Minute // only reached if fewer keys than expected are enqueued
+
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		threads := make([]domain.Thread, req.Limit)
+		for i := range threads {
+			threads[i] = domain.Thread{ID: int32(i + 1)}
+		}
+		return domain.ThreadsResponse{ID: req.ID, Threads: threads}
+	})
+	var batches [][]int32
+	var mu sync.Mutex
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		mu.Lock()
+		batches = append(batches, req.Threads)
+		mu.Unlock()
+		return domain.PostsResponse{ID: req.ID, Records: map[int32][]domain.Post{}}
+	})
+
+	start := time.Now()
+	out := execute(t, `{
+		threads(limit: 3) { a: posts(limit: 1) { id } b: posts(limit: 2) { id } }
+		threadsConnection(first: 2) { edges { node { postsConnection(first: 1) { pageInfo { hasNextPage } } } } }
+	}`)
+	assert.NotContains(t, out, `errors`)
+	assert.Less(t, time.Since(start), time.Second, `dispatched once the expected keys were enqueued`)
+	assert.Len(t, batches, 2, `one batch per list of threads`)
+
+	// two keys per thread: a and b share one, as do e and f (first defaults to 10), and d loads nothing
+	batches, start = nil, time.Now()
+	out = execute(t, `{ threads(limit: 3) {
+		a: posts(limit: 1) { id } b: posts(limit: 1) { id } d: posts(limit: -1) { id }
+		e: postsConnection { edges { cursor } } f: postsConnection(first: 10) { edges { cursor } }
+	} }`)
+	assert.Contains(t, out, `limit must be non-negative, got -1`)
+	assert.Less(t, time.Since(start), time.Second, `duplicate and invalid keys are not waited for`)
+	assert.Len(t, batches, 1)
+
+	// lists sharing threads: their posts may load interleaved, so each key is left to the first list expecting it
+	ctx := withLoaders(context.Background())
+	id := func(thread int32) int32 { return thread }
+	key := func(thread, limit int32) PostRequest { return PostRequest{Thread: thread, Limit: limit} }
+	start = time.Now()
+	expectPosts(ctx, []int32{1, 2}, id, []PostRequest{{Limit: 1}})
+	thunks := []dataloader.Thunk[[]domain.Post]{loaderFor(ctx, key(1, 1)).Load(ctx, key(1, 1))}
+	expectPosts(ctx, []int32{1, 2, 3}, id, []PostRequest{{Limit: 1}, {Limit: 2}})
+	for _, k := range []PostRequest{key(2, 1), key(1, 1), key(2, 1), key(3, 1), key(1, 2), key(2, 2), key(3, 2)} {
+		thunks = append(thunks, loaderFor(ctx, k).Load(ctx, k))
+	}
+	for _, thunk := range thunks {
+		_, err := thunk()
+		assert.NoError(t, err)
+	}
+	assert.Less(t, time.Since(start), time.Second, `neither list waits for keys the other loads`)
+}
+
+func TestPlanner(t *testing.T) {
+	defer func(on bool) { planning = on }(planning)
+	planning = true
+
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		return domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1}, {ID: 2}}}
+	})
+	var reqs []domain.PostsRequest
+	var mu sync.Mutex
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		records := make(map[int32][]domain.Post)
+		for _, thread := range req.Threads {
+			records[thread] = []domain.Post{{ID: thread * 10, Created: time.Unix(0, 0).UTC()}}
+		}
+		return domain.PostsResponse{ID: req.ID, Records: records}
+	})
+
+	s, err := graphql.NewSchema(schema)
+	require.NoError(t, err)
+	res := graphql.Do(graphql.Params{
+		Schema:         s,
+		RequestString:  `query($n: Int!, $m: Int!) { threads(limit: $n) { id posts(limit: $m) { id created } } }`,
+		VariableValues: map[string]any{`n`: 2, `m`: 5},
+		Context:        withLoaders(context.Background()),
+	})
+	require.Empty(t, res.Errors)
+	out, err := json.Marshal(res.Data)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"threads": [
+		{"id": 1, "posts": [{"id": 10, "created": "1970-01-01T00:00:00Z"}]},
+		{"id": 2, "posts": [{"id": 20, "created": "1970-01-01T00:00:00Z"}]}
+	]}`, string(out))
+	require.Len(t, reqs, 1)
+	assert.Equal(t, int32(5), reqs[0].Limit)
+	assert.Equal(t, []int32{1, 2}, reqs[0].Threads)
+	assert.Equal(t, []string{domain.FieldCreated}, reqs[0].Fields)
+
+	// other shapes fall back to the loader
+	reqs = nil
+	out2 := execute(t, `{ threads(limit: 2) { a: posts(limit: 1) { id } b: posts(limit: 2) { id } } }`)
+	assert.NotContains(t, out2, `errors`)
+	require.Len(t, reqs, 1)
+	assert.Equal(t, int32(2), reqs[0].Limit)
+}
+
+func TestStreaming(t *testing.T) {
+	defer func(on bool, chunk int32) { planning, threadsChunk = on, chunk }(planning, threadsChunk)
+	planning, threadsChunk = true, 2
+
+	requested := make(chan []int32, 2)
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		requested <- req.Threads
+		records := make(map[int32][]domain.Post)
+		for _, thread := range req.Threads {
+			records[thread] = []domain.Post{{ID: thread * 10}}
+		}
+		return domain.PostsResponse{ID: req.ID, Records: records}
+	})
+	fakeThreads.stream(func(req domain.ThreadsRequest, emit func(domain.ThreadsResponse) error) domain.ThreadsResponse {
+		assert.Equal(t, int32(2), req.Chunk)
+		emit(domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1}, {ID: 2}}, More: true})
+		select { // the last chunk is held back until the posts of the first were requested
+		case threads := <-requested:
+			assert.Equal(t, []int32{1, 2}, threads)
+		case <-time.After(time.Second):
+			t.Error(`posts were not requested before the end of the stream`)
+		}
+		return domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 3}}}
+	})
+
+	out := execute(t, `{ threads(limit: 3) { id posts(limit: 1) { id } } }`)
+	assert.JSONEq(t, `{"data": {"threads": [
+		{"id": 1, "posts": [{"id": 10}]},
+		{"id": 2, "posts": [{"id": 20}]},
+		{"id": 3, "posts": [{"id": 30}]}
+	]}}`, out)
+	assert.Equal(t, []int32{3}, <-requested)
+
+	// errors end the stream
+	fakeThreads.stream(func(req domain.ThreadsRequest, emit func(domain.ThreadsResponse) error) domain.ThreadsResponse {
+		emit(domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1}, {ID: 2}}, More: true})
+		return domain.ThreadsResponse{ID: req.ID, Error: &domain.Error{Code: domain.CodeInternal, Message: `rows: bad connection`}}
+	})
+	out = execute(t, `{ threads(limit: 3) { id posts(limit: 1) { id } } }`)
+	assert.Contains(t, out, `rows: bad connection`)
+	<-requested // the first chunk was prefetched all the same
+}
+
+// BenchmarkThreadsStream compares a single threads response with one streamed in chunks (THREADS_CHUNK) with
+// the planner on, when the threads service takes a while to read its rows, reporting the p95 latency.
+func BenchmarkThreadsStream(b *testing.B) {
+	const rowTime = 50 * time.Microsecond
+	fakeThreads.stream(func(req domain.ThreadsRequest, emit func(domain.ThreadsResponse) error) domain.ThreadsResponse {
+		var chunk []domain.Thread
+		for i := int32(0); i < req.Limit; i++ {
+			time.Sleep(rowTime)
+			chunk = append(chunk, domain.Thread{ID: i})
+			if req.Chunk > 0 && int32(len(chunk)) == req.Chunk {
+				emit(domain.ThreadsResponse{ID: req.ID, Threads: chunk, More: true})
+				chunk = nil
+			}
+		}
+		return domain.ThreadsResponse{ID: req.ID, Threads: chunk}
+	})
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		time.Sleep(500 * time.Microsecond) // query time
+		records := make(map[int32][]domain.Post, len(req.Threads))
+		for _, thread := range req.Threads {
+			records[thread] = make([]domain.Post, req.Limit)
+		}
+		return domain.PostsResponse{ID: req.ID, Records: records}
+	})
+	s, err := graphql.NewSchema(schema)
+	require.NoError(b, err)
+	h := handler.New(&handler.Config{Schema: &s, FormatErrorFn: formatError})
+	api, err := scoped(h, `request`)
+	require.NoError(b, err)
+	body := `{"query": "{ threads(limit: 20) { id posts(limit: 10) { id } } }"}`
+
+	defer func(on bool, chunk int32) { planning, threadsChunk = on, chunk }(planning, threadsChunk)
+	planning = true
+	for _, chunk := range []int32{0, 5} {
+		b.Run(fmt.Sprintf(`chunk=%d`, chunk), func(b *testing.B) {
+			threadsChunk = chunk
+			latencies := make([]time.Duration, 0, b.N)
+			for i := 0; i < b.N; i++ {
+				r := httptest.NewRequest(http.MethodPost, `/graphql`, strings.NewReader(body))
+				r.Header.Set(`Content-Type`, `application/json`)
+				w := httptest.NewRecorder()
+				start := time.Now()
+				api.ServeHTTP(w, r)
+				latencies = append(latencies, time.Since(start))
+				if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"errors"`) {
+					b.Errorf(`%d: %s`, w.Code, w.Body)
+				}
+			}
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*95/100].Microseconds()), `p95-µs`)
+		})
+	}
+}
+
+func TestTransports(t *testing.T) {
+	defer func(b backend, on bool, chunk int32) { services, planning, threadsChunk = b, on, chunk }(services, planning, threadsChunk)
+	created := time.Unix(1700000000, 0).UTC()
+	fakeThreads.stream(func(req domain.ThreadsRequest, emit func(domain.ThreadsResponse) error) domain.ThreadsResponse {
+		if req.Chunk > 0 {
+			emit(domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1, Created: created}}, More: true})
+			return domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 2, Created: created}}}
+		}
+		return domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1, Created: created}, {ID: 2, Created: created}}}
+	})
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		if req.Limit == 0 {
+			return domain.PostsResponse{ID: req.ID, Error: &domain.Error{Code: domain.CodeInternal, Message: `query: bad connection`}}
+		}
+		records := make(map[int32][]domain.Post)
+		for _, thread := range req.Threads {
+			records[thread] = []domain.Post{{ID: thread * 10, ThreadID: thread}}
+		}
+		return domain.PostsResponse{ID: req.ID, Records: records}
+	})
+
+	for transport, b := range backends {
+		for _, chunk := range []int32{0, 1} {
+			t.Run(fmt.Sprintf(`%s/chunk=%d`, transport, chunk), func(t *testing.T) {
+				services, planning, threadsChunk = b, chunk > 0, chunk
+				out := execute(t, `{ threads(limit: 2) { id created posts(limit: 1) { id threadId } } }`)
+				assert.JSONEq(t, `{"data": {"threads": [
+					{"id": 1, "created": "2023-11-14T22:13:20Z", "posts": [{"id": 10, "threadId": 1}]},
+					{"id": 2, "created": "2023-11-14T22:13:20Z", "posts": [{"id": 20, "threadId": 2}]}
+				]}}`, out)
+
+				out = execute(t, `{ threads(limit: 2) { posts(limit: 0) { id } } }`)
+				assert.Contains(t, out, `"code":"INTERNAL"`)
+				assert.Contains(t, out, `query: bad connection`)
+			})
+		}
+	}
+}
+
+// BenchmarkTransport compares gob and gRPC between the gateway and the services under concurrent load,
+// reporting the p95 latency of the challenge query.
+func BenchmarkTransport(b *testing.B) {
+	defer func(prev backend) { services = prev }(services)
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		threads := make([]domain.Thread, req.Limit)
+		for i := range threads {
+			threads[i].ID = int32(i)
+		}
+		return domain.ThreadsResponse{ID: req.ID, Threads: threads}
+	})
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		records := make(map[int32][]domain.Post, len(req.Threads))
+		for _, thread := range req.Threads {
+			posts := make([]domain.Post, req.Limit)
+			for i := range posts {
+				posts[i] = domain.Post{ID: int32(i), ThreadID: thread}
+			}
+			records[thread] = posts
+		}
+		return domain.PostsResponse{ID: req.ID, Records: records}
+	})
+	s, err := graphql.NewSchema(schema)
+	require.NoError(b, err)
+	h := handler.New(&handler.Config{Schema: &s, FormatErrorFn: formatError})
+	api, err := scoped(h, `request`)
+	require.NoError(b, err)
+	body := `{"query": "{ threads(limit: 4) { id posts(limit: 20) { id } } }"}`
+
+	for _, transport := range []string{`gob`, `grpc`} {
+		b.Run(transport, func(b *testing.B) {
+			services = backends[transport]
+			var mu sync.Mutex
+			latencies := make([]time.Duration, 0, b.N)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					r := httptest.NewRequest(http.MethodPost, `/graphql`, strings.NewReader(body))
+					r.Header.Set(`Content-Type`, `application/json`)
+					w := httptest.NewRecorder()
+					start := time.Now()
+					api.ServeHTTP(w, r)
+					took := time.Since(start)
+					if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"errors"`) {
+						b.Errorf(`%d: %s`, w.Code, w.Body)
+					}
+					mu.Lock()
+					latencies = append(latencies, took)
+					mu.Unlock()
+				}
+			})
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*95/100].Microseconds()), `p95-µs`)
+		})
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	defer func(b backend, c wire.Codec) { services, codec = b, c }(services, codec)
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		return domain.ThreadsResponse{ID: req.ID, Threads: []domain.Thread{{ID: 1, Created: time.Unix(0, 0).UTC()}}}
+	})
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		return domain.PostsResponse{ID: req.ID, Records: map[int32][]domain.Post{1: {{ID: 10, ThreadID: 1}}}}
+	})
+
+	for _, name := range []string{`gob`, `json`, `msgpack`, `varint`} {
+		t.Run(name, func(t *testing.T) {
+			var err error
+			codec, err = wire.Lookup(name)
+			require.NoError(t, err)
+			b := newGobBackend() // dials in codec
+			t.Cleanup(func() { assert.NoError(t, b.Close()) })
+			services = b
+			out := execute(t, `{ threads(limit: 1) { id created posts(limit: 1) { id threadId } } }`)
+			assert.JSONEq(t, `{"data": {"threads": [
+				{"id": 1, "created": "1970-01-01T00:00:00Z", "posts": [{"id": 10, "threadId": 1}]}
+			]}}`, out)
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	var mu sync.Mutex
+	var pinged []string
+	fakeThreads.set(func(req domain.ThreadsRequest) domain.ThreadsResponse {
+		if req.Ping {
+			mu.Lock()
+			pinged = append(pinged, `threads`)
+			mu.Unlock()
+		}
+		return domain.ThreadsResponse{ID: req.ID}
+	})
+	fakePosts.set(func(req domain.PostsRequest) domain.PostsResponse {
+		if req.Ping {
+			mu.Lock()
+			pinged = append(pinged, `posts`)
+			mu.Unlock()
+		}
+		return domain.PostsResponse{ID: req.ID}
+	})
+	ready := func(b backend) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		health.Register(mux, b.checks())
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, `/readyz`, nil))
+		return w
+	}
+
+	for transport, b := range backends {
+		t.Run(transport, func(t *testing.T) {
+			w := ready(b)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, `{"posts": "ok", "threads": "ok"}`, w.Body.String())
+		})
+	}
+	assert.ElementsMatch(t, []string{`posts`, `threads`}, pinged, `gob pings the services, gRPC only connects`)
+
+	t.Run(`down`, func(t *testing.T) {
+		refused := func(context.Context) (*client, error) { return nil, errors.New(`connection refused`) }
+		b := gobBackend{postsPool: pool.New(pool.Config{}, refused), threadsPool: backends[`gob`].(gobBackend).threadsPool}
+		defer b.postsPool.Close()
+		w := ready(b)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.JSONEq(t, `{"posts": "pool: dial: connection refused", "threads": "ok"}`, w.Body.String())
+	})
+}
+
+func TestBounded(t *testing.T) {
+	deadline := func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Deadline()
+		fmt.Fprint(w, ok)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(`/graphql`, bounded(http.HandlerFunc(deadline), time.Second))
+	mux.HandleFunc(`/debug/pprof/profile`, deadline)
+
+	for path, want := range map[string]string{`/graphql`: `true`, `/debug/pprof/profile`: `false`} {
+		w := httptest.NewRecorder()
+		measure(mux).ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, want, w.Body.String(), path)
+	}
+}
+
+func TestOperation(t *testing.T) {
+	for name, want := range map[string]string{
+		`MagicSauce`:  `MagicSauce`,
+		``:            `anonymous`,
+		`MagicSauce2`: `other`,
+	} {
+		assert.Equal(t, want, operation(name), name)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+	"github.com/bign8/supergraph-top-n-challenge/lib/env"
+	"github.com/bign8/supergraph-top-n-challenge/lib/health"
+	"github.com/bign8/supergraph-top-n-challenge/lib/rpc"
+)
+
+// grpcBackend sends requests over gRPC (TRANSPORT=grpc). Each connection multiplexes concurrent calls on its
+// own, so there is no pool; trace context and deadlines travel as gRPC metadata.
+type grpcBackend struct {
+	postsConn   *grpc.ClientConn
+	threadsConn *grpc.ClientConn
+}
+
+func newGRPCBackend() (grpcBackend, error) {
+	posts, err := rpc.Dial(env.Default(`POSTS_GRPC_HOST`, `[::]:9001`))
+	if err != nil {
+		return grpcBackend{}, fmt.Errorf(`dial posts: %w`, err)
+	}
+	threads, err := rpc.Dial(env.Default(`THREADS_GRPC_HOST`, `[::]:9002`))
+	if err != nil {
+		posts.Close()
+		return grpcBackend{}, fmt.Errorf(`dial threads: %w`, err)
+	}
+	return grpcBackend{postsConn: posts, threadsConn: threads}, nil
+}
+
+func (b grpcBackend) threads(ctx context.Context, req domain.ThreadsRequest, onChunk func([]domain.Thread)) func() (domain.ThreadsResponse, error) {
+	ctx, cancel := context.WithCancel(ctx) // releases the stream if it is not read to its end
+	recv, err := rpc.ListThreads(ctx, b.threadsConn, &req)
+	return func() (domain.ThreadsResponse, error) {
+		defer cancel()
+		if err != nil {
+			return domain.ThreadsResponse{}, err
+		}
+		res, err := collect(func() (domain.ThreadsResponse, error) {
+			res, err := recv()
+			if err == io.EOF {
+				return domain.ThreadsResponse{}, fmt.Errorf(`threads: stream ended early: %w`, io.ErrUnexpectedEOF)
+			} else if err != nil {
+				return domain.ThreadsResponse{}, err
+			}
+			return *res, nil
+		}, onChunk)
+		if err == nil {
+			recv() // reads the end of the stream, releasing it
+		}
+		return res, err
+	}
+}
+
+func (b grpcBackend) postsBatch(ctx context.Context, limit int32, fields []string, threads []int32, after map[int32]domain.Cursor) func() (map[int32][]domain.Post, error) {
+	req := domain.PostsRequest{
+		Limit:   limit,
+		Threads: threads,
+		Fields:  fields,
+		After:   after,
+	}
+	ch := make(chan reply, 1)
+	go func() { // unary calls block, while callers expect the request to be on its way when this returns
+		res, err := rpc.BatchPosts(ctx, b.postsConn, &req)
+		ch <- reply{res: res, err: err}
+	}()
+	return func() (map[int32][]domain.Post, error) {
+		r := <-ch
+		if r.err != nil {
+			return nil, r.err
+		}
+		out := r.res.(*domain.PostsResponse)
+		if out.Error != nil {
+			return nil, out.Error
+		}
+		return out.Records, nil
+	}
+}
+
+func (b grpcBackend) checks() map[string]health.Check {
+	return map[string]health.Check{
+		`posts`:   func(ctx context.Context) error { return rpc.Ready(ctx, b.postsConn) },
+		`threads`: func(ctx context.Context) error { return rpc.Ready(ctx, b.threadsConn) },
+	}
+}
+
+func (b grpcBackend) Close() error {
+	return errors.Join(b.postsConn.Close(), b.threadsConn.Close())
+}
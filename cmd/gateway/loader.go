@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	dataloader "github.com/graph-gophers/dataloader/v7"
+	"go.opentelemetry.io/otel"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+	"github.com/bign8/supergraph-top-n-challenge/lib/metrics"
+)
+
+type PostRequest struct {
+	Limit  int32
+	Thread int32
+	Fields string // comma separated projection (keys must be comparable)
+	After  string // encoded domain.Cursor, empty for the first page
+}
+
+// postsBatch is one request to the posts service. A thread appears at most once per request, so keys
+// asking for a thread at different cursors (e.g. aliased connections) are spread over several requests.
+type postsBatch struct {
+	threads []int32
+	after   map[int32]string
+	keys    []int // indexes of the keys served
+}
+
+func (b *postsBatch) add(i int, req PostRequest) bool {
+	if after, ok := b.after[req.Thread]; ok {
+		if after != req.After {
+			return false
+		}
+	} else {
+		b.after[req.Thread] = req.After
+		b.threads = append(b.threads, req.Thread)
+	}
+	b.keys = append(b.keys, i)
+	return true
+}
+
+func loadBatch(ctx context.Context, keys []PostRequest) []*dataloader.Result[[]domain.Post] {
+
+	ctx, span := otel.Tracer(``).Start(ctx, `loadBatch`)
+	defer span.End()
+
+	// keys may ask for different limits (e.g. aliased fields): fetch the largest and trim per key
+	var limit int32
+	var fields []string
+	var batches []*postsBatch
+	for i, req := range keys {
+		limit = max(limit, req.Limit)
+		// union: extra fields are harmless to those that didn't ask
+		if req.Fields != `` {
+			fields = union(fields, strings.Split(req.Fields, `,`)...)
+		}
+		added := false
+		for _, b := range batches {
+			if added = b.add(i, req); added {
+				break
+			}
+		}
+		if !added {
+			b := &postsBatch{after: make(map[int32]string)}
+			b.add(i, req)
+			batches = append(batches, b)
+		}
+	}
+	res := make([]*dataloader.Result[[]domain.Post], len(keys))
+
+	var wg sync.WaitGroup
+	wg.Add(len(batches))
+	for _, b := range batches {
+		go func(b *postsBatch) {
+			defer wg.Done()
+			data, err := fetchPosts(ctx, limit, fields, b.threads, b.cursors())
+			if err != nil {
+				span.RecordError(err)
+				err = newServiceError(`posts`, err, b.threads)
+			}
+			for _, i := range b.keys {
+				posts := data[keys[i].Thread]
+				if int(keys[i].Limit) < len(posts) {
+					posts = posts[:keys[i].Limit]
+				}
+				res[i] = &dataloader.Result[[]domain.Post]{Data: posts, Error: err}
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	return res
+}
+
+// cursors decodes the after cursors, which were validated by the resolvers.
+func (b *postsBatch) cursors() map[int32]domain.Cursor {
+	var out map[int32]domain.Cursor
+	for thread, raw := range b.after {
+		if raw == `` {
+			continue
+		}
+		if out == nil {
+			out = make(map[int32]domain.Cursor)
+		}
+		out[thread], _ = domain.ParseCursor(raw)
+	}
+	return out
+}
+
+func fetchPosts(ctx context.Context, limit int32, fields []string, threads []int32, after map[int32]domain.Cursor) (map[int32][]domain.Post, error) {
+	return sendPosts(ctx, limit, fields, threads, after)()
+}
+
+// sendPosts writes a posts request, returning a func that waits for its response.
+func sendPosts(ctx context.Context, limit int32, fields []string, threads []int32, after map[int32]domain.Cursor) func() (map[int32][]domain.Post, error) {
+	return services.postsBatch(ctx, limit, fields, threads, after)
+}
+
+// batchWait bounds how long a batch waits for the keys it expects (see LOADER_MAX_WAIT in main).
+var batchWait = time.Millisecond
+
+// newLoader batches posts keys: once expect distinct keys are enqueued the batch is dispatched right away,
+// otherwise after batchWait. Without an expectation (expect = 0) batches are only bounded by a short window.
+func newLoader(expect int) *dataloader.Loader[PostRequest, []domain.Post] {
+	opts := []dataloader.Option[PostRequest, []domain.Post]{
+		dataloader.WithWait[PostRequest, []domain.Post](100 * time.Nanosecond),
+		dataloader.WithTracer[PostRequest, []domain.Post](&batchTracer{}),
+	}
+	if expect > 0 {
+		// keeps its cache (it lives as long as the request), so duplicate keys loaded after the batch is
+		// dispatched are served by it rather than starting a batch that never fills
+		opts = append(opts,
+			dataloader.WithBatchCapacity[PostRequest, []domain.Post](expect),
+			dataloader.WithWait[PostRequest, []domain.Post](batchWait),
+		)
+	} else {
+		opts = append(opts, dataloader.WithClearCacheOnBatch[PostRequest, []domain.Post]()) // clearing batches in good faith
+	}
+	return dataloader.NewBatchedLoader(loadBatch, opts...)
+}
+
+// batchTracer measures the batches of a loader (see metrics.BatchSize and metrics.BatchWait).
+type batchTracer struct {
+	dataloader.NoopTracer[PostRequest, []domain.Post]
+
+	mu    sync.Mutex // guards first
+	first time.Time  // of the keys loaded since the last batch
+}
+
+func (t *batchTracer) TraceLoad(ctx context.Context, key PostRequest) (context.Context, dataloader.TraceLoadFinishFunc[[]domain.Post]) {
+	t.mu.Lock()
+	if t.first.IsZero() {
+		t.first = time.Now()
+	}
+	t.mu.Unlock()
+	return t.NoopTracer.TraceLoad(ctx, key)
+}
+
+func (t *batchTracer) TraceBatch(ctx context.Context, keys []PostRequest) (context.Context, dataloader.TraceBatchFinishFunc[[]domain.Post]) {
+	t.mu.Lock()
+	if !t.first.IsZero() {
+		metrics.BatchWait.Observe(time.Since(t.first).Seconds())
+		t.first = time.Time{}
+	}
+	t.mu.Unlock()
+	metrics.BatchSize.Observe(float64(len(keys)))
+	return t.NoopTracer.TraceBatch(ctx, keys)
+}
+
+// sharedLoader batches keys across requests (LOADER_SCOPE=global), and serves contexts without loaders.
+var sharedLoader = newLoader(0)
+
+// loaders are the loaders of one request: one per resolved list of threads, sized by the keys it was first
+// to expect. A key expected by several lists (threads listed twice) is counted by the first only.
+type loaders struct {
+	fallback *dataloader.Loader[PostRequest, []domain.Post]
+
+	mu         sync.Mutex // guards everything below
+	byKey      map[PostRequest]*dataloader.Loader[PostRequest, []domain.Post]
+	prefetched map[int32]*prefetch // see planner.go
+}
+
+type loadersKey struct{}
+
+// withLoaders gives ctx its own loaders, so a batch only ever holds keys (and errors) of one request.
+func withLoaders(ctx context.Context) context.Context {
+	return context.WithValue(ctx, loadersKey{}, &loaders{
+		fallback:   newLoader(0),
+		byKey:      make(map[PostRequest]*dataloader.Loader[PostRequest, []domain.Post]),
+		prefetched: make(map[int32]*prefetch),
+	})
+}
+
+// expectPosts prepares a loader for the posts of threads, expecting keys (see postsKeys) to be loaded on each.
+// Keys already expected by another list stay with its loader, which counted them.
+func expectPosts[T any](ctx context.Context, threads []T, id func(T) int32, keys []PostRequest) {
+	ls, ok := ctx.Value(loadersKey{}).(*loaders)
+	if !ok || len(threads) == 0 || len(keys) == 0 {
+		return
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var fresh []PostRequest
+	for _, thread := range threads {
+		for _, key := range keys {
+			key.Thread = id(thread)
+			if _, ok := ls.byKey[key]; !ok {
+				ls.byKey[key] = nil // set below, counting threads listed twice once
+				fresh = append(fresh, key)
+			}
+		}
+	}
+	if len(fresh) == 0 {
+		return
+	}
+	l := newLoader(len(fresh))
+	for _, key := range fresh {
+		ls.byKey[key] = l
+	}
+}
+
+func loaderFor(ctx context.Context, key PostRequest) *dataloader.Loader[PostRequest, []domain.Post] {
+	ls, ok := ctx.Value(loadersKey{}).(*loaders)
+	if !ok {
+		return sharedLoader
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if l, ok := ls.byKey[key]; ok {
+		return l
+	}
+	return ls.fallback
+}
+
+// scoped attaches request scoped loaders unless scope is `global`, which shares sharedLoader across requests.
+func scoped(h http.Handler, scope string) (http.Handler, error) {
+	switch scope {
+	case `request`:
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(withLoaders(r.Context())))
+		}), nil
+	case `global`:
+		return h, nil
+	}
+	return nil, fmt.Errorf(`unknown LOADER_SCOPE: %q`, scope)
+}
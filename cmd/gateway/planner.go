@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+// planning enables the fast path for the challenge's query shape (QUERY_PLANNER=on), where the posts of the
+// threads are requested as soon as the threads are decoded rather than once graphql-go has resolved each thread
+// and the loader has batched them. It needs request scoped loaders (LOADER_SCOPE=request).
+var planning bool
+
+// threadsChunk asks the threads service to stream its response in chunks of this many threads (THREADS_CHUNK),
+// so the planner requests the posts of the first threads while the rest are still being read. Zero disables it.
+var threadsChunk int32
+
+// prefetch is a posts request issued by the planner, shared by the threads it covers.
+type prefetch struct {
+	req     PostRequest // Thread unset
+	threads []int32
+	wait    func() (map[int32][]domain.Post, error)
+}
+
+// planPosts recognizes threads { posts(limit: m) { ... } }: a single posts field whose limit (and
+// projection) is known before any thread is resolved.
+func planPosts(info graphql.ResolveInfo) (PostRequest, bool) {
+	var found []*ast.Field
+	visit(info, func(f *ast.Field) {
+		if postsFields[f.Name.Value] {
+			found = append(found, f)
+		}
+	})
+	if len(found) != 1 || found[0].Name.Value != `posts` {
+		return PostRequest{}, false
+	}
+	limit, ok := intArg(info, found[0], `limit`)
+	if !ok || limit < 0 {
+		return PostRequest{}, false
+	}
+	posts := info
+	posts.FieldASTs = found
+	return PostRequest{
+		Limit:  int32(limit),
+		Fields: strings.Join(project(posts, postColumns), `,`),
+	}, true
+}
+
+// intArg reads an Int argument given as a literal or a variable.
+func intArg(info graphql.ResolveInfo, f *ast.Field, name string) (int, bool) {
+	for _, arg := range f.Arguments {
+		if arg.Name.Value != name {
+			continue
+		}
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			n, err := strconv.Atoi(v.Value)
+			return n, err == nil
+		case *ast.Variable:
+			n, ok := info.VariableValues[v.Name.Value].(int)
+			return n, ok
+		}
+	}
+	return 0, false
+}
+
+// prefetchPosts requests the posts of threads as planned. It may be called repeatedly as threads arrive.
+func prefetchPosts(ctx context.Context, planned PostRequest, threads []domain.Thread) {
+	ls, ok := ctx.Value(loadersKey{}).(*loaders)
+	if !ok || len(threads) == 0 {
+		return
+	}
+	ids := make([]int32, len(threads))
+	for i, thread := range threads {
+		ids[i] = thread.ID
+	}
+	var fields []string
+	if planned.Fields != `` {
+		fields = strings.Split(planned.Fields, `,`)
+	}
+	pf := &prefetch{
+		req:     planned,
+		threads: ids,
+		wait:    sync.OnceValues(sendPosts(ctx, planned.Limit, fields, ids, nil)),
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, id := range ids {
+		ls.prefetched[id] = pf
+	}
+}
+
+// prefetched returns a thunk for req if the planner already requested it.
+func prefetched(ctx context.Context, req PostRequest) (func() ([]domain.Post, error), bool) {
+	ls, ok := ctx.Value(loadersKey{}).(*loaders)
+	if !ok {
+		return nil, false
+	}
+	ls.mu.Lock()
+	pf := ls.prefetched[req.Thread]
+	ls.mu.Unlock()
+	if pf == nil || pf.req.Limit != req.Limit || pf.req.Fields != req.Fields || req.After != `` {
+		return nil, false
+	}
+	return func() ([]domain.Post, error) {
+		data, err := pf.wait()
+		if err != nil {
+			return nil, newServiceError(`posts`, err, pf.threads)
+		}
+		return data[req.Thread], nil
+	}, true
+}
@@ -3,20 +3,32 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/uptrace/opentelemetry-go-extra/otelsql"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/propagation"
 
 	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
 	"github.com/bign8/supergraph-top-n-challenge/lib/env"
+	"github.com/bign8/supergraph-top-n-challenge/lib/graceful"
+	"github.com/bign8/supergraph-top-n-challenge/lib/health"
+	"github.com/bign8/supergraph-top-n-challenge/lib/metrics"
+	"github.com/bign8/supergraph-top-n-challenge/lib/projection"
+	"github.com/bign8/supergraph-top-n-challenge/lib/rest"
+	"github.com/bign8/supergraph-top-n-challenge/lib/rpc"
 	"github.com/bign8/supergraph-top-n-challenge/lib/tracing"
+	"github.com/bign8/supergraph-top-n-challenge/lib/wire"
 )
 
 func check(err error) {
@@ -29,26 +41,97 @@ const DSN = `postgres://postgres:postgrespassword@[::]:7432?sslmode=disable`
 
 func main() {
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
-	tracing.Init(`posts`)
+	flush, err := tracing.Init(`posts`)
+	var settings *tracing.SettingsError
+	if errors.As(err, &settings) {
+		check(err) // rather than run with telemetry other than configured
+	} else if err != nil {
+		log.Printf(`running without telemetry: %v`, err)
+	}
 	p, err := newProcessor()
 	check(err)
-	l, err := net.Listen(`tcp`, `:8001`) // TODO: test UDP
+	signaled, stop := graceful.Signal()
+	defer stop()
+	var stops []func(context.Context) error // per transport: stop accepting and drain
+	for _, transport := range strings.Split(env.Default(`TRANSPORTS`, `gob,grpc,http`), `,`) {
+		switch transport {
+		case `gob`:
+			l, err := net.Listen(`tcp`, `:8001`) // TODO: test UDP
+			check(err)
+			log.Printf(`posts on %v`, l.Addr())
+			s := &graceful.Server{Handle: p.processBatch}
+			go func() { check(s.Serve(l)) }()
+			stops = append(stops, s.Shutdown)
+		case `grpc`:
+			l, err := net.Listen(`tcp`, `:9001`)
+			check(err)
+			log.Printf(`posts (grpc) on %v`, l.Addr())
+			s := rpc.NewServer()
+			rpc.RegisterPosts(s, p)
+			go func() { check(s.Serve(l)) }()
+			stops = append(stops, func(ctx context.Context) error { return rpc.Shutdown(ctx, s) })
+		case `http`:
+			mux := http.NewServeMux()
+			mux.Handle(`/posts`, rest.Handle(p.handlePosts))
+			server := &http.Server{Addr: `:8101`, Handler: mux}
+			log.Printf(`posts (http) on %v`, server.Addr)
+			go func() {
+				if err := server.ListenAndServe(); err != http.ErrServerClosed {
+					check(err)
+				}
+			}()
+			stops = append(stops, server.Shutdown)
+		default:
+			log.Fatalf(`unknown transport %q`, transport)
+		}
+	}
+	admin := http.NewServeMux() // outlives draining, so probes see it and metrics are scraped until the end
+	health.Register(admin, map[string]health.Check{
+		`serving`:    health.Until(signaled),
+		`db`:         p.db.PingContext,
+		`statements`: p.checkStatements,
+	})
+	metrics.Register(admin)
+	log.Printf(`posts (admin) on :8201`)
+	go func() { check(http.ListenAndServe(`:8201`, admin)) }()
+	timeout, err := time.ParseDuration(env.Default(`SHUTDOWN_TIMEOUT`, `8s`))
 	check(err)
-	log.Printf(`posts on %v`, l.Addr())
-	for {
-		conn, err := l.Accept()
-		check(err)
-		log.Printf(`received connection: %v`, conn.RemoteAddr())
-		go func() {
-			check(p.processBatch(conn))
-		}()
+
+	<-signaled.Done()
+	log.Printf(`shutting down (waiting up to %v)`, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := graceful.Stop(ctx, stops...); err != nil {
+		log.Printf(`draining: %v`, err)
+	}
+	if err := p.Close(); err != nil {
+		log.Printf(`closing statements: %v`, err)
+	}
+	if err := flush(ctx); err != nil {
+		log.Printf(`flushing telemetry: %v`, err)
 	}
 }
 
+// columns are the projectable posts columns (see domain.PostsRequest.Fields).
+var columns = []projection.Column[domain.Post]{{
+	Name: domain.FieldCreated,
+	Expr: `(EXTRACT(EPOCH FROM created) * 1000000)::bigint`, // unix micros scan into arrays without date parsing
+	Set: func(post *domain.Post, v sql.NullInt64) {
+		if v.Valid { // else NULL, left zero
+			post.Created = time.UnixMicro(v.Int64).UTC()
+		}
+	},
+}}
+
 type processor struct {
-	threadPostsViaRows  *sql.Stmt // SLOW: see usage in posts_test
-	threadPostsViaArray *sql.Stmt // SLOW: see usage in posts_test
-	multiThreadPosts    *sql.Stmt
+	db                  *sql.DB
+	threadPostsViaRows  *projection.Query[domain.Post] // SLOW: see BenchmarkFanOutRows
+	threadPostsViaArray *projection.Query[domain.Post] // SLOW: see BenchmarkFanOutArray
+	multiThreadPosts    *projection.Query[domain.Post]
+	lateralThreadPosts  *projection.Query[domain.Post]
+	pageThreadPosts     *projection.Query[domain.Post] // lateralThreadPosts after per-thread cursors
+
+	strategy BatchStrategy
 }
 
 func newProcessor() (*processor, error) {
@@ -59,33 +142,119 @@ func newProcessor() (*processor, error) {
 		span.RecordError(err)
 		return nil, fmt.Errorf(`sql.Open: %w`, err)
 	}
-	fetchThreadPostsViaRows, err := db.PrepareContext(ctx, `SELECT id FROM posts WHERE thread_id = $1 LIMIT $2;`)
+	fetchThreadPostsViaRows, err := projection.Prepare(ctx, db, columns,
+		`SELECT id%s FROM posts WHERE thread_id = $1 ORDER BY created DESC, id DESC LIMIT $2;`,
+		`, %[1]s`)
 	if err != nil {
 		span.RecordError(err)
 		return nil, fmt.Errorf(`prepare(rows): %w`, err)
 	}
-	fetchThreadPostsViaArray, err := db.PrepareContext(ctx, `SELECT ARRAY(SELECT id FROM posts WHERE thread_id = $1 LIMIT $2);`)
+	fetchThreadPostsViaArray, err := projection.Prepare(ctx, db, columns,
+		`SELECT ARRAY(SELECT id FROM posts WHERE thread_id = $1 ORDER BY created DESC, id DESC LIMIT $2)%s;`,
+		`, ARRAY(SELECT %[1]s FROM posts WHERE thread_id = $1 ORDER BY created DESC, id DESC LIMIT $2)`)
 	if err != nil {
 		span.RecordError(err)
 		return nil, fmt.Errorf(`prepare(array): %w`, err)
 	}
-	fetchMultiThreadPosts, err := db.PrepareContext(ctx, `SELECT thread_id, (array_agg(id))[1:$2] FROM posts
-		WHERE thread_id = ANY($1) GROUP BY thread_id;`)
+	fetchMultiThreadPosts, err := projection.Prepare(ctx, db, columns,
+		`SELECT thread_id, (array_agg(id ORDER BY created DESC, id DESC))[1:$2]%s FROM posts
+		WHERE thread_id = ANY($1) GROUP BY thread_id;`,
+		`, (array_agg(%[1]s ORDER BY created DESC, id DESC))[1:$2]`)
 	if err != nil {
 		span.RecordError(err)
 		return nil, fmt.Errorf(`prepare(multi): %w`, err)
 	}
-	return &processor{
+	// cost scales with $2 (posts read per thread) rather than aggregating every post of every thread
+	fetchLateralThreadPosts, err := projection.Prepare(ctx, db, columns,
+		`SELECT t.id, p.ids%s FROM unnest($1::integer[]) AS t(id)
+		CROSS JOIN LATERAL (
+			SELECT array_agg(id ORDER BY created DESC, id DESC) AS ids%s FROM (
+				SELECT * FROM posts WHERE thread_id = t.id ORDER BY created DESC, id DESC LIMIT $2
+			) top
+		) p;`,
+		`, p.%[2]s`,
+		`, array_agg(%[1]s ORDER BY created DESC, id DESC) AS %[2]s`)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf(`prepare(lateral): %w`, err)
+	}
+	// keyset pagination: threads without a cursor (after_id) get their first page, as from lateralThreadPosts.
+	// NULL created sort first: after a NULL cursor come the NULLs of lower id, then every dated post.
+	fetchPageThreadPosts, err := projection.Prepare(ctx, db, columns,
+		`SELECT t.id, p.ids%s FROM unnest($1::integer[], $3::bigint[], $4::integer[]) AS t(id, after_created, after_id)
+		CROSS JOIN LATERAL (
+			SELECT array_agg(id ORDER BY created DESC, id DESC) AS ids%s FROM (
+				SELECT * FROM posts WHERE thread_id = t.id AND (t.after_id IS NULL OR CASE
+					WHEN t.after_created IS NULL THEN created IS NOT NULL OR id < t.after_id
+					ELSE (created, id) < ('epoch'::timestamp + t.after_created * interval '1 microsecond', t.after_id)
+				END) ORDER BY created DESC, id DESC LIMIT $2
+			) top
+		) p;`,
+		`, p.%[2]s`,
+		`, array_agg(%[1]s ORDER BY created DESC, id DESC) AS %[2]s`)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf(`prepare(page): %w`, err)
+	}
+	p := &processor{
+		db:                  db,
 		threadPostsViaRows:  fetchThreadPostsViaRows,
 		threadPostsViaArray: fetchThreadPostsViaArray,
 		multiThreadPosts:    fetchMultiThreadPosts,
-	}, nil
+		lateralThreadPosts:  fetchLateralThreadPosts,
+		pageThreadPosts:     fetchPageThreadPosts,
+	}
+	p.strategy, err = p.newBatchStrategy(env.Default(`POSTS_STRATEGY`, `multi`))
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkStatements runs the batch queries for no threads.
+func (p processor) checkStatements(ctx context.Context) error {
+	return errors.Join(
+		p.multiThreadPosts.Check(ctx, pq.Int32Array{}, 0),
+		p.lateralThreadPosts.Check(ctx, pq.Int32Array{}, 0),
+	)
+}
+
+// Close closes the prepared statements, then the database.
+func (p processor) Close() error {
+	return errors.Join(
+		p.threadPostsViaRows.Close(),
+		p.threadPostsViaArray.Close(),
+		p.multiThreadPosts.Close(),
+		p.lateralThreadPosts.Close(),
+		p.pageThreadPosts.Close(),
+		p.db.Close(),
+	)
 }
 
 func (p processor) processBatch(conn net.Conn) error {
 	defer conn.Close()
-	reader := gob.NewDecoder(conn)
-	writer := gob.NewEncoder(conn)
+	codec, writer, reader, err := wire.Accept(conn) // gob, unless the client asked for another codec
+	if err == io.EOF {
+		log.Printf(`closing connection: %v`, conn.RemoteAddr())
+		return nil
+	} else if err != nil {
+		return fmt.Errorf(`handshake: %w`, err)
+	}
+	log.Printf(`speaking %s with %v`, codec.Name(), conn.RemoteAddr())
+	var mu sync.Mutex // guards writer and packed
+	var packed []byte // gob copies it out on Encode, so every packed response reuses it
+	write := func(v any) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if res, ok := v.(domain.PostsResponse); ok && res.Packed != nil && codec == wire.Gob {
+			packed = res.Packed.AppendBinary(packed[:0])
+			v = domain.PackedResponse{ID: res.ID, Packed: packed, Error: res.Error}
+		}
+		return writer.Encode(v)
+	}
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
 
 	for {
 
@@ -97,49 +266,118 @@ func (p processor) processBatch(conn net.Conn) error {
 		} else if err != nil {
 			return fmt.Errorf(`decode: %w`, err)
 		}
+		if args.Ping {
+			if err := write(domain.PostsResponse{ID: args.ID}); err != nil {
+				return fmt.Errorf(`pong: %w`, err)
+			}
+			continue
+		}
 
-		// TODO: propagate span properties from request headers
-		ctx := context.Background() // gotta start somewhere!
-		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(args.Headers))
-		ctx, span := otel.Tracer(``).Start(ctx, `processBatch`)
+		// requests are answered as they complete, possibly out of order (matched by ID)
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			if err := p.serve(args, write); err != nil {
+				log.Printf(`dropping connection %v: %v`, conn.RemoteAddr(), err)
+				conn.Close()
+			}
+		}()
+	}
+}
 
-		result := p.fetchBatchMulti(ctx, args)
+func (p processor) serve(args domain.PostsRequest, write func(any) error) error {
+	// TODO: propagate span properties from request headers
+	ctx := context.Background() // gotta start somewhere!
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(args.Headers))
+	ctx, cancel := domain.ExtractDeadline(ctx, args.Headers) // queries are canceled once the caller gives up
+	defer cancel()
+	ctx, span := otel.Tracer(``).Start(ctx, `processBatch`)
+	defer span.End()
 
-		// write result
-		if err := writer.Encode(result); err != nil {
-			span.RecordError(err)
-			span.End()
-			return fmt.Errorf(`encode: %w`, err)
-		}
-		span.End()
+	result, err := p.fetchBatch(ctx, args)
+	if err != nil {
+		span.RecordError(err)
+		log.Printf(`processBatch: %v`, err)
+	}
+	result.ID = args.ID
+
+	// write result
+	if err := write(result); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf(`encode: %w`, err)
 	}
+	return nil
 }
 
-// TODO: measure (used in processBatch)
-func (p processor) fetchBatchMulti(ctx context.Context, args domain.PostsRequest) domain.PostsResponse {
-	// start := time.Now()
-	result := domain.PostsResponse{
-		Posts: make(map[int32][]int32, len(args.Threads)),
+// Batch serves req over gRPC; like serve, failures are reported in the response.
+func (p processor) Batch(ctx context.Context, req *domain.PostsRequest) (*domain.PostsResponse, error) {
+	ctx, span := otel.Tracer(``).Start(ctx, `processBatch`)
+	defer span.End()
+	req.Version = domain.PostsVersion
+	result, err := p.fetchBatch(ctx, *req)
+	if err != nil {
+		span.RecordError(err)
+		log.Printf(`processBatch: %v`, err)
 	}
+	return &result, nil
+}
 
-	// convert unsigned => signed (domain => postgres)
-	threads := make([]int32, len(args.Threads))
-	for i, threadID := range args.Threads {
-		threads[i] = int32(threadID)
+// handlePosts serves GET /posts?threads=1,2&limit=&fields= (fields defaults to all of them).
+func (p processor) handlePosts(r *http.Request) (any, *domain.Error) {
+	q := r.URL.Query()
+	req := domain.PostsRequest{Version: domain.PostsVersion, Fields: rest.List(q, `fields`)}
+	if _, ok := q[`fields`]; !ok {
+		req.Fields = []string{domain.FieldCreated}
 	}
+	var derr *domain.Error
+	if req.Limit, derr = rest.Int32(q, `limit`, 10); derr != nil {
+		return nil, derr
+	}
+	if req.Threads, derr = rest.Int32s(q, `threads`); derr != nil {
+		return nil, derr
+	}
+	ctx, span := otel.Tracer(``).Start(r.Context(), `processBatch`)
+	defer span.End()
+	result, err := p.fetchBatch(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		log.Printf(`processBatch: %v`, err)
+	}
+	return result, result.Error
+}
 
-	rows, err := p.multiThreadPosts.QueryContext(ctx, pq.Int32Array(threads), args.Limit)
-	check(err)
-	var (
-		thread      int32
-		postsSigned pq.Int32Array
-	)
-	for rows.Next() {
-		check(rows.Scan(&thread, &postsSigned))
-		result.Posts[thread] = postsSigned
+// fetchBatch validates args and runs the configured strategy, folding any failure into the response
+func (p processor) fetchBatch(ctx context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+	defer prometheus.NewTimer(metrics.Requests.WithLabelValues(`posts`)).ObserveDuration()
+	if args.Limit < 0 {
+		return domain.PostsResponse{Error: &domain.Error{
+			Code:    domain.CodeInvalidArgument,
+			Message: fmt.Sprintf(`limit must be non-negative, got %d`, args.Limit),
+		}}, nil
+	}
+	strategy := p.strategy
+	if len(args.After) > 0 {
+		strategy = BatchStrategyFunc(p.fetchBatchPage)
+	}
+	result, err := strategy.FetchBatch(ctx, args)
+	if err != nil {
+		return domain.PostsResponse{Error: domain.NewError(ctx, err)}, err
 	}
-	check(rows.Err())
 
-	// log.Printf(`fetching %d posts of %d threads took %s`, args.Limit, len(args.Threads), time.Since(start))
-	return result
+	// TODO: drop once every gateway sends domain.PostsVersion
+	if args.Version < domain.PostsVersion {
+		result.Posts = make(map[int32][]int32, len(result.Records))
+		for thread, posts := range result.Records {
+			ids := make([]int32, len(posts))
+			for i, post := range posts {
+				ids[i] = post.ID
+			}
+			result.Posts[thread] = ids
+		}
+		result.Records = nil
+	}
+	if args.Version >= domain.PostsPackedVersion {
+		result.Packed, result.Records = result.Records, nil
+	}
+	return result, nil
 }
@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"sync"
+	"encoding/gob"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+	"github.com/bign8/supergraph-top-n-challenge/lib/rest"
 )
 
 // postgres populated with data from db/posts.sql
@@ -60,15 +67,26 @@ var request = domain.PostsRequest{
 }
 
 func checkResults(tb testing.TB, res domain.PostsResponse) {
-	assert.Len(tb, res.Posts, 40)
+	assert.Len(tb, res.Records, 40)
 	if request.Limit < 1997 {
-		assert.Len(tb, res.Posts[1704120699], int(request.Limit))
+		assert.Len(tb, res.Records[1704120699], int(request.Limit))
 	} else {
-		assert.Len(tb, res.Posts[1704120699], 1997)
+		assert.Len(tb, res.Records[1704120699], 1997)
 	}
 
 }
 
+// ids strips records down to their post IDs
+func ids(records map[int32][]domain.Post) map[int32][]int32 {
+	out := make(map[int32][]int32, len(records))
+	for thread, posts := range records {
+		for _, post := range posts {
+			out[thread] = append(out[thread], post.ID)
+		}
+	}
+	return out
+}
+
 func connect(tb testing.TB) *processor {
 	p, err := newProcessor()
 	if err != nil {
@@ -78,110 +96,372 @@ func connect(tb testing.TB) *processor {
 	return p
 }
 
+var strategies = []string{`multi`, `lateral`, `fan-out-array`, `fan-out-rows`}
+
+func strategy(tb testing.TB, p *processor, name string) BatchStrategy {
+	s, err := p.newBatchStrategy(name)
+	require.NoError(tb, err)
+	return s
+}
+
 func TestProcessor(t *testing.T) {
 	p := connect(t)
 
-	t.Run(`multi`, func(t *testing.T) {
-		res := p.fetchBatchMulti(context.Background(), request)
-		checkResults(t, res)
+	for _, name := range strategies {
+		s := strategy(t, p, name)
+		t.Run(name, func(t *testing.T) {
+			res, err := s.FetchBatch(context.Background(), request)
+			require.NoError(t, err)
+			checkResults(t, res)
+
+			huge := request // e.g. GET /posts?limit=2147483647
+			huge.Limit = math.MaxInt32
+			res, err = s.FetchBatch(context.Background(), huge)
+			require.NoError(t, err)
+			assert.Len(t, res.Records, len(request.Threads))
+		})
+	}
+}
+
+// expected results taken from the README "Test Cases / Examples"
+func TestOrdering(t *testing.T) {
+	p := connect(t)
+
+	for _, name := range strategies {
+		s := strategy(t, p, name)
+		t.Run(name, func(t *testing.T) {
+			// Case 1
+			res, err := s.FetchBatch(context.Background(), domain.PostsRequest{
+				Limit:   2,
+				Threads: []int32{212991383},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, map[int32][]int32{
+				212991383: {1300957267, 1679625662},
+			}, ids(res.Records))
+
+			// Case 2
+			res, err = s.FetchBatch(context.Background(), domain.PostsRequest{
+				Limit:   1,
+				Threads: []int32{212991383, 1194533456},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, map[int32][]int32{
+				212991383:  {1300957267},
+				1194533456: {1206315650},
+			}, ids(res.Records))
+		})
+	}
+}
+
+func TestPagination(t *testing.T) {
+	p := connect(t)
+
+	first, err := p.fetchBatch(context.Background(), domain.PostsRequest{
+		Version: domain.PostsVersion,
+		Limit:   1,
+		Threads: []int32{212991383, 1194533456},
+		Fields:  []string{domain.FieldCreated},
+	})
+	require.NoError(t, err)
+	post := first.Records[212991383][0]
+	next, err := p.fetchBatch(context.Background(), domain.PostsRequest{
+		Version: domain.PostsVersion,
+		Limit:   1,
+		Threads: []int32{212991383, 1194533456},
+		After:   map[int32]domain.Cursor{212991383: domain.NewCursor(post.Created, post.ID)},
 	})
+	require.NoError(t, err)
+	assert.Equal(t, map[int32][]int32{
+		212991383:  {1679625662}, // second page
+		1194533456: {1206315650}, // no cursor: first page
+	}, ids(next.Records))
+}
+
+func TestCreated(t *testing.T) {
+	p := connect(t)
+
+	for _, name := range strategies {
+		s := strategy(t, p, name)
+		t.Run(name, func(t *testing.T) {
+			res, err := s.FetchBatch(context.Background(), domain.PostsRequest{
+				Limit:   3,
+				Threads: []int32{212991383},
+				Fields:  []string{domain.FieldCreated},
+			})
+			require.NoError(t, err)
+			posts := res.Records[212991383]
+			require.Len(t, posts, 3)
+			for i, post := range posts {
+				assert.Equal(t, int32(212991383), post.ThreadID)
+				assert.False(t, post.Created.IsZero())
+				if i > 0 {
+					assert.False(t, post.Created.After(posts[i-1].Created), `newest first`)
+				}
+			}
+		})
+	}
+}
 
-	t.Run(`fanOutArray`, func(t *testing.T) {
-		res := p.fetchBatchFanOut(request, p.fetchThreadPostsViaArray)
-		checkResults(t, res)
+// nullPostID is not in db/posts.sql.
+const nullPostID = math.MaxInt32
+
+func TestNullCreated(t *testing.T) {
+	p := connect(t)
+	_, err := p.db.Exec(`INSERT INTO posts (id, thread_id, created) VALUES ($1, $2, NULL);`, nullPostID, 212991383)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, err := p.db.Exec(`DELETE FROM posts WHERE id = $1;`, nullPostID)
+		assert.NoError(t, err)
 	})
 
-	t.Run(`fanOutRows`, func(t *testing.T) {
-		res := p.fetchBatchFanOut(request, p.fetchThreadPostsViaRows)
-		checkResults(t, res)
+	for _, name := range strategies {
+		s := strategy(t, p, name)
+		t.Run(name, func(t *testing.T) {
+			res, err := s.FetchBatch(context.Background(), domain.PostsRequest{
+				Limit:   2,
+				Threads: []int32{212991383},
+				Fields:  []string{domain.FieldCreated},
+			})
+			require.NoError(t, err)
+			posts := res.Records[212991383]
+			require.Len(t, posts, 2)
+			assert.Equal(t, domain.Post{ID: nullPostID, ThreadID: 212991383}, posts[0], `NULLs first, Created left zero`)
+			assert.Equal(t, int32(1300957267), posts[1].ID)
+		})
+	}
+
+	next, err := p.fetchBatch(context.Background(), domain.PostsRequest{
+		Version: domain.PostsVersion,
+		Limit:   1,
+		Threads: []int32{212991383, 1194533456},
+		After:   map[int32]domain.Cursor{212991383: domain.NewCursor(time.Time{}, nullPostID)},
 	})
+	require.NoError(t, err)
+	assert.Equal(t, map[int32][]int32{
+		212991383:  {1300957267}, // paged past
+		1194533456: {1206315650}, // no cursor: first page
+	}, ids(next.Records))
 }
 
 func BenchmarkMulti(b *testing.B) {
 	p := connect(b)
-	benchmark(b, p.fetchBatchMulti)
+	benchmark(b, strategy(b, p, `multi`))
+}
+
+func BenchmarkLateral(b *testing.B) {
+	p := connect(b)
+	benchmark(b, strategy(b, p, `lateral`))
 }
 
 func BenchmarkFanOutArray(b *testing.B) {
 	p := connect(b)
-	benchmark(b, func(_ context.Context, pr domain.PostsRequest) domain.PostsResponse {
-		return p.fetchBatchFanOut(pr, p.fetchThreadPostsViaArray)
-	})
+	benchmark(b, strategy(b, p, `fan-out-array`))
 }
 
 func BenchmarkFanOutRows(b *testing.B) {
 	p := connect(b)
-	benchmark(b, func(_ context.Context, pr domain.PostsRequest) domain.PostsResponse {
-		return p.fetchBatchFanOut(pr, p.fetchThreadPostsViaRows)
-	})
+	benchmark(b, strategy(b, p, `fan-out-rows`))
 }
 
-func benchmark(b *testing.B, subject func(context.Context, domain.PostsRequest) domain.PostsResponse) {
+func benchmark(b *testing.B, subject BatchStrategy) {
 	for i := 0; i < b.N; i++ {
-		res := subject(context.Background(), request)
+		res, err := subject.FetchBatch(context.Background(), request)
+		require.NoError(b, err)
 		checkResults(b, res)
 	}
 }
 
-/// KEEPING THE FOLLOWING AROUND FOR TESTING COMPARISON
+func TestFanOutParallelism(t *testing.T) {
+	var running, peak int32
+	f := fanOut{
+		parallelism: 3,
+		fetch: func(_ context.Context, args domain.PostsRequest, threadID int32) ([]domain.Post, error) {
+			now := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if now <= old || atomic.CompareAndSwapInt32(&peak, old, now) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return []domain.Post{{ID: args.Limit, ThreadID: threadID}}, nil
+		},
+	}
+	res, err := f.FetchBatch(context.Background(), request)
+	require.NoError(t, err)
+	assert.Len(t, res.Records, 40)
+	assert.Equal(t, []domain.Post{{ID: request.Limit, ThreadID: 1704120699}}, res.Records[1704120699])
+	assert.LessOrEqual(t, atomic.LoadInt32(&peak), int32(3))
+}
 
-// TODO: measure (used in processBatch)
-func (p processor) fetchBatchFanOut(args domain.PostsRequest, fn func(threadID, limit int32) ([]int32, error)) domain.PostsResponse {
-	// TODO: short circut if only 1 thread fetched
+func TestFanOutError(t *testing.T) {
+	f := fanOut{
+		parallelism: 3,
+		fetch: func(_ context.Context, _ domain.PostsRequest, threadID int32) ([]domain.Post, error) {
+			if threadID == 355369712 {
+				return nil, errors.New(`boom`)
+			}
+			return []domain.Post{{ID: threadID}}, nil
+		},
+	}
+	_, err := f.FetchBatch(context.Background(), request)
+	assert.EqualError(t, err, `thread 355369712: boom`)
+}
 
-	// start := time.Now()
+func TestProcessBatchSurvivesErrors(t *testing.T) {
+	p := processor{strategy: BatchStrategyFunc(func(_ context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+		if args.Threads[0] == 0 {
+			return domain.PostsResponse{}, errors.New(`connection reset`)
+		}
+		return domain.PostsResponse{Records: map[int32][]domain.Post{args.Threads[0]: {{ID: 1}}}}, nil
+	})}
+	server, client := net.Pipe()
+	done := make(chan error)
+	go func() { done <- p.processBatch(server) }()
 
-	// query database
-	var wg sync.WaitGroup
-	var stage sync.Map
-	wg.Add(int(len(args.Threads)))
-	for _, threadID := range args.Threads {
-		go func(threadID int32) {
-			defer wg.Done()
-			out, err := fn(threadID, args.Limit)
-			check(err)
-			stage.Store(threadID, out)
-		}(threadID)
+	enc, dec := gob.NewEncoder(client), gob.NewDecoder(client)
+	roundTrip := func(req domain.PostsRequest) domain.PostsResponse {
+		require.NoError(t, enc.Encode(req))
+		var res domain.PostsResponse
+		require.NoError(t, dec.Decode(&res))
+		return res
 	}
-	wg.Wait()
 
-	// serialize
-	result := domain.PostsResponse{
-		Posts: make(map[int32][]int32, int(args.Limit)),
-	}
-	stage.Range(func(key, value any) bool {
-		result.Posts[key.(int32)] = value.([]int32)
-		return true
-	})
-	// log.Printf(`fetching %d posts of %d threads took %s`, args.Limit, len(args.Threads), time.Since(start))
-	return result
+	res := roundTrip(domain.PostsRequest{ID: 1, Limit: 1, Threads: []int32{0}})
+	assert.Equal(t, uint64(1), res.ID)
+	assert.Equal(t, &domain.Error{Code: domain.CodeInternal, Message: `connection reset`}, res.Error)
+
+	res = roundTrip(domain.PostsRequest{ID: 2, Limit: -1, Threads: []int32{1}})
+	assert.Equal(t, uint64(2), res.ID)
+	require.NotNil(t, res.Error)
+	assert.Equal(t, domain.CodeInvalidArgument, res.Error.Code)
+
+	res = roundTrip(domain.PostsRequest{ID: 3, Limit: 1, Threads: []int32{7}})
+	assert.Equal(t, uint64(3), res.ID)
+	assert.Nil(t, res.Error)
+	assert.Equal(t, map[int32][]int32{7: {1}}, res.Posts, `legacy callers get bare IDs`)
+
+	res = roundTrip(domain.PostsRequest{ID: 4, Limit: 1, Threads: []int32{7}, Version: domain.PostsVersion})
+	assert.Equal(t, uint64(4), res.ID)
+	assert.Nil(t, res.Posts)
+	assert.Equal(t, map[int32][]domain.Post{7: {{ID: 1}}}, res.Records)
+
+	res = roundTrip(domain.PostsRequest{ID: 5, Limit: 1, Threads: []int32{7}, Version: domain.PostsPackedVersion})
+	assert.Equal(t, uint64(5), res.ID)
+	assert.Nil(t, res.Records)
+	assert.Equal(t, domain.PackedRecords{7: {{ID: 1, ThreadID: 7}}}, res.Packed, `packed posts are listed under their thread`)
+	res = roundTrip(domain.PostsRequest{ID: 6, Limit: 1, Threads: []int32{8}, Version: domain.PostsPackedVersion})
+	assert.Equal(t, domain.PackedRecords{8: {{ID: 1, ThreadID: 8}}}, res.Packed, `packed into the reused buffer`)
+
+	require.NoError(t, client.Close())
+	assert.NoError(t, <-done)
 }
 
-// TODO: measure (used in fetchBatchFanOut)
-func (p processor) fetchThreadPostsViaRows(threadID, limit int32) ([]int32, error) {
-	rows, err := p.threadPostsViaRows.Query(threadID, limit)
-	if err != nil {
-		return nil, fmt.Errorf(`query: %w`, err)
-	}
-	output := make([]int32, 0, limit)
-	for rows.Next() {
-		var id int32
-		if err := rows.Scan(&id); err != nil {
-			return nil, fmt.Errorf(`scan: %w`, err)
+func TestProcessBatchPing(t *testing.T) {
+	p := processor{strategy: BatchStrategyFunc(func(context.Context, domain.PostsRequest) (domain.PostsResponse, error) {
+		t.Error(`pings are not queried`)
+		return domain.PostsResponse{}, nil
+	})}
+	server, client := net.Pipe()
+	done := make(chan error)
+	go func() { done <- p.processBatch(server) }()
+
+	require.NoError(t, gob.NewEncoder(client).Encode(domain.PostsRequest{ID: 9, Ping: true}))
+	var res domain.PostsResponse
+	require.NoError(t, gob.NewDecoder(client).Decode(&res))
+	assert.Equal(t, domain.PostsResponse{ID: 9}, res)
+
+	require.NoError(t, client.Close())
+	assert.NoError(t, <-done)
+}
+
+func TestProcessBatchOutOfOrder(t *testing.T) {
+	release := make(chan struct{})
+	p := processor{strategy: BatchStrategyFunc(func(_ context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+		if args.Threads[0] == 0 {
+			<-release // slow query
 		}
-		output = append(output, id)
-	}
-	if err := rows.Close(); err != nil {
-		return nil, fmt.Errorf(`close: %w`, err)
-	}
-	return output, nil
+		return domain.PostsResponse{Records: map[int32][]domain.Post{args.Threads[0]: {{ID: 1}}}}, nil
+	})}
+	server, client := net.Pipe()
+	done := make(chan error)
+	go func() { done <- p.processBatch(server) }()
+
+	enc, dec := gob.NewEncoder(client), gob.NewDecoder(client)
+	require.NoError(t, enc.Encode(domain.PostsRequest{ID: 1, Limit: 1, Threads: []int32{0}}))
+	require.NoError(t, enc.Encode(domain.PostsRequest{ID: 2, Limit: 1, Threads: []int32{5}}))
+
+	var res domain.PostsResponse
+	require.NoError(t, dec.Decode(&res))
+	assert.Equal(t, uint64(2), res.ID, `fast request is not blocked by the slow one`)
+
+	close(release)
+	res = domain.PostsResponse{}
+	require.NoError(t, dec.Decode(&res))
+	assert.Equal(t, uint64(1), res.ID)
+
+	require.NoError(t, client.Close())
+	assert.NoError(t, <-done)
 }
 
-// TODO: measure (used in fetchBatchFanOut)
-func (p processor) fetchThreadPostsViaArray(threadID, limit int32) ([]int32, error) {
-	var arr pq.Int32Array
-	if err := p.threadPostsViaArray.QueryRow(threadID, limit).Scan(&arr); err != nil {
-		return nil, fmt.Errorf(`query/scan: %w`, err)
-	}
-	return arr, nil
+func TestHTTP(t *testing.T) {
+	var got domain.PostsRequest
+	p := processor{strategy: BatchStrategyFunc(func(_ context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+		got = args
+		records := make(map[int32][]domain.Post)
+		for _, thread := range args.Threads {
+			records[thread] = []domain.Post{{ID: thread * 10, ThreadID: thread, Created: time.Unix(0, 0).UTC()}}
+		}
+		return domain.PostsResponse{Records: records}, nil
+	})}
+	h := rest.Handle(p.handlePosts)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/posts?threads=1,2&limit=1`, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, domain.PostsRequest{
+		Limit:   1,
+		Threads: []int32{1, 2},
+		Version: domain.PostsVersion,
+		Fields:  []string{domain.FieldCreated}, // all of them by default
+	}, got)
+	assert.JSONEq(t, `{"records": {
+		"1": [{"id": 10, "threadId": 1, "created": "1970-01-01T00:00:00Z"}],
+		"2": [{"id": 20, "threadId": 2, "created": "1970-01-01T00:00:00Z"}]
+	}}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/posts?threads=1&fields=`, nil))
+	assert.Equal(t, int32(10), got.Limit, `default limit`)
+	assert.Empty(t, got.Fields)
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/posts?threads=1&limit=-1`, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `limit must be non-negative`)
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/posts?threads=one`, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDeadline(t *testing.T) {
+	p := processor{strategy: BatchStrategyFunc(func(ctx context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+		<-ctx.Done() // a query that would otherwise run forever
+		return domain.PostsResponse{}, ctx.Err()
+	})}
+	var res domain.PostsResponse
+	err := p.serve(domain.PostsRequest{
+		ID:      9,
+		Headers: map[string]string{domain.HeaderTimeout: `10ms`},
+	}, func(v any) error {
+		res = v.(domain.PostsResponse)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(9), res.ID)
+	require.NotNil(t, res.Error)
+	assert.Equal(t, domain.CodeDeadlineExceeded, res.Error.Code)
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+	"github.com/bign8/supergraph-top-n-challenge/lib/env"
+	"github.com/bign8/supergraph-top-n-challenge/lib/metrics"
+	"github.com/bign8/supergraph-top-n-challenge/lib/projection"
+)
+
+// BatchStrategy fetches the first args.Limit posts of every thread in args.Threads.
+type BatchStrategy interface {
+	FetchBatch(ctx context.Context, args domain.PostsRequest) (domain.PostsResponse, error)
+}
+
+// BatchStrategyFunc adapts a plain function into a BatchStrategy.
+type BatchStrategyFunc func(ctx context.Context, args domain.PostsRequest) (domain.PostsResponse, error)
+
+func (fn BatchStrategyFunc) FetchBatch(ctx context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+	return fn(ctx, args)
+}
+
+// newBatchStrategy selects a strategy by name (see POSTS_STRATEGY in main).
+func (p *processor) newBatchStrategy(name string) (BatchStrategy, error) {
+	raw := env.Default(`POSTS_FANOUT_PARALLELISM`, `8`)
+	parallelism, err := strconv.Atoi(raw)
+	if err != nil || parallelism < 1 {
+		return nil, fmt.Errorf(`invalid POSTS_FANOUT_PARALLELISM: %q`, raw)
+	}
+	switch name {
+	case `multi`:
+		return BatchStrategyFunc(p.fetchBatchMulti), nil
+	case `lateral`:
+		return BatchStrategyFunc(p.fetchBatchLateral), nil
+	case `fan-out-rows`:
+		return fanOut{fetch: p.fetchThreadPostsViaRows, parallelism: parallelism}, nil
+	case `fan-out-array`:
+		return fanOut{fetch: p.fetchThreadPostsViaArray, parallelism: parallelism}, nil
+	}
+	return nil, fmt.Errorf(`unknown POSTS_STRATEGY: %q`, name)
+}
+
+// fetchBatchMulti aggregates every post of the threads of args, then keeps the first args.Limit of each.
+func (p processor) fetchBatchMulti(ctx context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+	return scanBatch(ctx, `multi`, p.multiThreadPosts, args)
+}
+
+// fetchBatchLateral reads only the first args.Limit posts of each thread, rather than aggregating all of them.
+func (p processor) fetchBatchLateral(ctx context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+	return scanBatch(ctx, `lateral`, p.lateralThreadPosts, args)
+}
+
+// fetchBatchPage serves keyset paginated requests (see domain.PostsRequest.After), whatever the strategy.
+func (p processor) fetchBatchPage(ctx context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+	created := make([]sql.NullInt64, len(args.Threads))
+	ids := make([]sql.NullInt32, len(args.Threads))
+	for i, thread := range args.Threads {
+		if after, ok := args.After[thread]; ok {
+			created[i] = sql.NullInt64{Int64: after.Created, Valid: after.HasCreated()}
+			ids[i] = sql.NullInt32{Int32: after.ID, Valid: true}
+		}
+	}
+	return scanBatch(ctx, `page`, p.pageThreadPosts, args, pq.GenericArray{A: created}, pq.GenericArray{A: ids})
+}
+
+// scanBatch runs a multi-thread query (timed as statement) returning rows of (thread, post IDs, projected
+// column arrays...). Its parameters are the threads, the limit, then extra.
+func scanBatch(ctx context.Context, statement string, q *projection.Query[domain.Post], args domain.PostsRequest, extra ...any) (domain.PostsResponse, error) {
+	result := domain.PostsResponse{
+		Records: make(map[int32][]domain.Post, len(args.Threads)),
+	}
+
+	stmt, cols, err := q.Stmt(ctx, args.Fields)
+	if err != nil {
+		return result, err
+	}
+	defer prometheus.NewTimer(metrics.Queries.WithLabelValues(statement)).ObserveDuration()
+	rows, err := stmt.QueryContext(ctx, append([]any{pq.Int32Array(args.Threads), args.Limit}, extra...)...)
+	if err != nil {
+		return result, fmt.Errorf(`query: %w`, err)
+	}
+	defer rows.Close()
+	var (
+		thread int32
+		ids    pq.Int32Array
+		values = make([]projection.NullInt64Array, len(cols))
+		dest   = []any{&thread, &ids}
+	)
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return result, fmt.Errorf(`scan: %w`, err)
+		}
+		result.Records[thread] = records(thread, ids, cols, values)
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf(`rows: %w`, err)
+	}
+	return result, nil
+}
+
+// records zips post IDs with the arrays of their projected columns.
+func records(thread int32, ids []int32, cols []projection.Column[domain.Post], values []projection.NullInt64Array) []domain.Post {
+	out := make([]domain.Post, len(ids))
+	for i, id := range ids {
+		out[i] = domain.Post{ID: id, ThreadID: thread}
+		for c, col := range cols {
+			col.Set(&out[i], values[c][i])
+		}
+	}
+	return out
+}
+
+// fanOut issues one query per thread, running at most parallelism queries at once.
+type fanOut struct {
+	fetch       func(ctx context.Context, args domain.PostsRequest, threadID int32) ([]domain.Post, error)
+	parallelism int
+}
+
+// FetchBatch queries the threads of args, f.parallelism at a time, failing the batch on the first error.
+func (f fanOut) FetchBatch(ctx context.Context, args domain.PostsRequest) (domain.PostsResponse, error) {
+	// short circuit if only 1 thread fetched
+	if len(args.Threads) == 1 {
+		out, err := f.fetch(ctx, args, args.Threads[0])
+		if err != nil {
+			return domain.PostsResponse{}, fmt.Errorf(`thread %d: %w`, args.Threads[0], err)
+		}
+		return domain.PostsResponse{
+			Records: map[int32][]domain.Post{args.Threads[0]: out},
+		}, nil
+	}
+	parallelism := f.parallelism
+	if parallelism > len(args.Threads) {
+		parallelism = len(args.Threads)
+	}
+
+	// query database (first failure cancels the remaining queries)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		stage   = make([][]domain.Post, len(args.Threads))
+		work    = make(chan int)
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		failure error
+	)
+	wg.Add(parallelism)
+	for w := 0; w < parallelism; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if ctx.Err() != nil {
+					continue // drain
+				}
+				out, err := f.fetch(ctx, args, args.Threads[i])
+				if err != nil {
+					errOnce.Do(func() {
+						failure = fmt.Errorf(`thread %d: %w`, args.Threads[i], err)
+						cancel()
+					})
+					continue
+				}
+				stage[i] = out
+			}
+		}()
+	}
+	for i := range args.Threads {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	if failure != nil {
+		return domain.PostsResponse{}, failure
+	}
+	if err := ctx.Err(); err != nil {
+		return domain.PostsResponse{}, err
+	}
+
+	// serialize
+	result := domain.PostsResponse{
+		Records: make(map[int32][]domain.Post, len(args.Threads)),
+	}
+	for i, threadID := range args.Threads {
+		result.Records[threadID] = stage[i]
+	}
+	return result, nil
+}
+
+// preallocate caps the room reserved for the posts of a thread: over HTTP, gob or gRPC, args.Limit can be
+// anything up to MaxInt32 while threads hold a handful of posts.
+const preallocate = 1 << 10
+
+// fetchThreadPostsViaRows reads the first args.Limit posts of threadID one row at a time (fan-out-rows).
+func (p processor) fetchThreadPostsViaRows(ctx context.Context, args domain.PostsRequest, threadID int32) ([]domain.Post, error) {
+	stmt, cols, err := p.threadPostsViaRows.Stmt(ctx, args.Fields)
+	if err != nil {
+		return nil, err
+	}
+	defer prometheus.NewTimer(metrics.Queries.WithLabelValues(`rows`)).ObserveDuration()
+	rows, err := stmt.QueryContext(ctx, threadID, args.Limit)
+	if err != nil {
+		return nil, fmt.Errorf(`query: %w`, err)
+	}
+	defer rows.Close()
+	var (
+		output = make([]domain.Post, 0, min(args.Limit, preallocate))
+		values = make([]sql.NullInt64, len(cols))
+		dest   = make([]any, 1+len(cols))
+	)
+	for i := range values {
+		dest[1+i] = &values[i]
+	}
+	for rows.Next() {
+		post := domain.Post{ThreadID: threadID}
+		dest[0] = &post.ID
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf(`scan: %w`, err)
+		}
+		for i, col := range cols {
+			col.Set(&post, values[i])
+		}
+		output = append(output, post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(`rows: %w`, err)
+	}
+	return output, nil
+}
+
+// fetchThreadPostsViaArray reads the first args.Limit posts of threadID as one row of arrays (fan-out-array).
+func (p processor) fetchThreadPostsViaArray(ctx context.Context, args domain.PostsRequest, threadID int32) ([]domain.Post, error) {
+	stmt, cols, err := p.threadPostsViaArray.Stmt(ctx, args.Fields)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ids    pq.Int32Array
+		values = make([]projection.NullInt64Array, len(cols))
+		dest   = []any{&ids}
+	)
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	defer prometheus.NewTimer(metrics.Queries.WithLabelValues(`array`)).ObserveDuration()
+	if err := stmt.QueryRowContext(ctx, threadID, args.Limit).Scan(dest...); err != nil {
+		return nil, fmt.Errorf(`query/scan: %w`, err)
+	}
+	return records(threadID, ids, cols, values), nil
+}
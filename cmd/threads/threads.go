@@ -3,21 +3,34 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/uptrace/opentelemetry-go-extra/otelsql"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
 	"github.com/bign8/supergraph-top-n-challenge/lib/env"
+	"github.com/bign8/supergraph-top-n-challenge/lib/graceful"
+	"github.com/bign8/supergraph-top-n-challenge/lib/health"
+	"github.com/bign8/supergraph-top-n-challenge/lib/metrics"
+	"github.com/bign8/supergraph-top-n-challenge/lib/projection"
+	"github.com/bign8/supergraph-top-n-challenge/lib/rest"
+	"github.com/bign8/supergraph-top-n-challenge/lib/rpc"
 	"github.com/bign8/supergraph-top-n-challenge/lib/tracing"
+	"github.com/bign8/supergraph-top-n-challenge/lib/wire"
 )
 
 func check(err error) {
@@ -30,24 +43,93 @@ const DSN = `postgres://postgres:postgrespassword@[::]:8432?sslmode=disable`
 
 func main() {
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
-	tracing.Init(`threads`)
+	flush, err := tracing.Init(`threads`)
+	var settings *tracing.SettingsError
+	if errors.As(err, &settings) {
+		check(err) // rather than run with telemetry other than configured
+	} else if err != nil {
+		log.Printf(`running without telemetry: %v`, err)
+	}
 	p, err := newProcessor()
 	check(err)
-	l, err := net.Listen(`tcp`, `:8002`) // TODO: test UDP
+	signaled, stop := graceful.Signal()
+	defer stop()
+	var stops []func(context.Context) error // per transport: stop accepting and drain
+	for _, transport := range strings.Split(env.Default(`TRANSPORTS`, `gob,grpc,http`), `,`) {
+		switch transport {
+		case `gob`:
+			l, err := net.Listen(`tcp`, `:8002`) // TODO: test UDP
+			check(err)
+			log.Printf(`threads on %v`, l.Addr())
+			s := &graceful.Server{Handle: p.process}
+			go func() { check(s.Serve(l)) }()
+			stops = append(stops, s.Shutdown)
+		case `grpc`:
+			l, err := net.Listen(`tcp`, `:9002`)
+			check(err)
+			log.Printf(`threads (grpc) on %v`, l.Addr())
+			s := rpc.NewServer()
+			rpc.RegisterThreads(s, p)
+			go func() { check(s.Serve(l)) }()
+			stops = append(stops, func(ctx context.Context) error { return rpc.Shutdown(ctx, s) })
+		case `http`:
+			mux := http.NewServeMux()
+			mux.Handle(`/threads`, rest.Handle(p.handleThreads))
+			server := &http.Server{Addr: `:8102`, Handler: mux}
+			log.Printf(`threads (http) on %v`, server.Addr)
+			go func() {
+				if err := server.ListenAndServe(); err != http.ErrServerClosed {
+					check(err)
+				}
+			}()
+			stops = append(stops, server.Shutdown)
+		default:
+			log.Fatalf(`unknown transport %q`, transport)
+		}
+	}
+	admin := http.NewServeMux() // outlives draining, so probes see it and metrics are scraped until the end
+	health.Register(admin, map[string]health.Check{
+		`serving`:    health.Until(signaled),
+		`db`:         p.db.PingContext,
+		`statements`: p.checkStatements,
+	})
+	metrics.Register(admin)
+	log.Printf(`threads (admin) on :8202`)
+	go func() { check(http.ListenAndServe(`:8202`, admin)) }()
+	timeout, err := time.ParseDuration(env.Default(`SHUTDOWN_TIMEOUT`, `8s`))
 	check(err)
-	log.Printf(`threads on %v`, l.Addr())
-	for {
-		conn, err := l.Accept()
-		check(err)
-		log.Printf(`received connection: %v`, conn.RemoteAddr())
-		go func() {
-			check(p.process(conn))
-		}()
+
+	<-signaled.Done()
+	log.Printf(`shutting down (waiting up to %v)`, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := graceful.Stop(ctx, stops...); err != nil {
+		log.Printf(`draining: %v`, err)
+	}
+	if err := p.Close(); err != nil {
+		log.Printf(`closing statements: %v`, err)
+	}
+	if err := flush(ctx); err != nil {
+		log.Printf(`flushing telemetry: %v`, err)
 	}
 }
 
+// columns are the projectable threads columns (see domain.ThreadsRequest.Fields).
+var columns = []projection.Column[domain.Thread]{{
+	Name: domain.FieldCreated,
+	Expr: `(EXTRACT(EPOCH FROM created) * 1000000)::bigint`,
+	Set: func(thread *domain.Thread, v sql.NullInt64) {
+		if v.Valid { // else NULL, left zero
+			thread.Created = time.UnixMicro(v.Int64).UTC()
+		}
+	},
+}}
+
 type processor struct {
-	rowsParser *sql.Stmt
+	query      func(context.Context, domain.ThreadsRequest, func([]domain.Thread) error) ([]domain.Thread, error) // processRows
+	db         *sql.DB
+	rowsParser *projection.Query[domain.Thread]
+	pageParser *projection.Query[domain.Thread] // rowsParser after a domain.Cursor
 	arrParser  *sql.Stmt
 }
 
@@ -59,26 +141,68 @@ func newProcessor() (*processor, error) {
 		span.RecordError(err)
 		return nil, fmt.Errorf(`sql.Open: %w`, err)
 	}
-	rowsParser, err := db.PrepareContext(ctx, `SELECT id FROM threads LIMIT $1;`)
+	rowsParser, err := projection.Prepare(ctx, db, columns,
+		`SELECT id%s FROM threads ORDER BY created DESC, id DESC LIMIT $1;`,
+		`, %[1]s`)
 	if err != nil {
 		span.RecordError(err)
 		return nil, fmt.Errorf(`db.Prepare(rows): %w`, err)
 	}
-	arrParser, err := db.PrepareContext(ctx, `SELECT ARRAY_AGG(a.id) FROM (SELECT id FROM threads LIMIT $1) a;`)
+	// keyset pagination: (created, id) is unique and matches the sort, so pages never skip or repeat threads.
+	// NULL created sort first: after a NULL cursor ($2) come the NULLs of lower id, then every dated thread.
+	pageParser, err := projection.Prepare(ctx, db, columns,
+		`SELECT id%s FROM threads
+		WHERE CASE WHEN $2::bigint IS NULL THEN created IS NOT NULL OR id < $3::integer
+			ELSE (created, id) < ('epoch'::timestamp + $2::bigint * interval '1 microsecond', $3::integer) END
+		ORDER BY created DESC, id DESC LIMIT $1;`,
+		`, %[1]s`)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf(`db.Prepare(page): %w`, err)
+	}
+	arrParser, err := db.PrepareContext(ctx, `SELECT ARRAY(SELECT id FROM threads ORDER BY created DESC, id DESC LIMIT $1);`)
 	if err != nil {
 		span.RecordError(err)
 		return nil, fmt.Errorf(`db.Prepare(arr): %w`, err)
 	}
-	return &processor{
+	p := &processor{
+		db:         db,
 		rowsParser: rowsParser,
+		pageParser: pageParser,
 		arrParser:  arrParser,
-	}, nil
+	}
+	p.query = p.processRows
+	return p, nil
+}
+
+// checkStatements runs the threads query for no threads.
+func (p processor) checkStatements(ctx context.Context) error {
+	return p.rowsParser.Check(ctx, 0)
+}
+
+// Close closes the prepared statements, then the database.
+func (p processor) Close() error {
+	return errors.Join(p.rowsParser.Close(), p.pageParser.Close(), p.arrParser.Close(), p.db.Close())
 }
 
 func (p processor) process(conn net.Conn) error {
 	defer conn.Close()
-	reader := gob.NewDecoder(conn)
-	writer := gob.NewEncoder(conn)
+	codec, writer, reader, err := wire.Accept(conn) // gob, unless the client asked for another codec
+	if err == io.EOF {
+		log.Printf(`closing connection: %v`, conn.RemoteAddr())
+		return nil
+	} else if err != nil {
+		return fmt.Errorf(`handshake: %w`, err)
+	}
+	log.Printf(`speaking %s with %v`, codec.Name(), conn.RemoteAddr())
+	var mu sync.Mutex // guards writer
+	write := func(v any) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return writer.Encode(v)
+	}
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
 	for {
 
 		// parse input
@@ -89,46 +213,202 @@ func (p processor) process(conn net.Conn) error {
 		} else if err != nil {
 			return fmt.Errorf(`decode: %w`, err)
 		}
+		if req.Ping {
+			if err := write(domain.ThreadsResponse{ID: req.ID}); err != nil {
+				return fmt.Errorf(`pong: %w`, err)
+			}
+			continue
+		}
+
+		// requests are answered as they complete, possibly out of order (matched by ID)
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			if err := p.serve(req, write); err != nil {
+				log.Printf(`dropping connection %v: %v`, conn.RemoteAddr(), err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (p processor) serve(req domain.ThreadsRequest, write func(any) error) error {
+	// TODO: propagate span properties from request headers
+	ctx := context.Background() // gotta start somewhere!
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(req.Headers))
+	ctx, cancel := domain.ExtractDeadline(ctx, req.Headers) // queries are canceled once the caller gives up
+	defer cancel()
+	ctx, span := start(ctx, req)
+	defer span.End()
+
+	// stream rows as they are read, if asked to; services without streaming reply with a single last frame
+	var emit func([]domain.Thread) error
+	if req.Chunk > 0 && req.Version >= domain.ThreadsVersion {
+		span.SetAttributes(attribute.Int(`chunk`, int(req.Chunk)))
+		emit = func(threads []domain.Thread) error {
+			return write(domain.ThreadsResponse{ID: req.ID, Threads: threads, More: true})
+		}
+	}
 
-		// TODO: propagate span properties from request headers
-		ctx := context.Background() // gotta start somewhere!
-		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(req.Headers))
-		ctx, span := otel.Tracer(``).Start(ctx, `processRequest`)
-		span.SetAttributes(attribute.Int(`limit`, int(req.Limit)))
+	output := p.respond(ctx, req, emit)
+	output.ID = req.ID
 
-		// query database
-		output, err := p.processRows(ctx, req.Limit)
+	// TODO: drop once every gateway sends domain.ThreadsVersion
+	var msg any = output
+	switch {
+	case req.Version >= domain.ThreadsVersion:
+	case req.Version > 0: // IDs instead of records
+		output.IDs = ids(output.Threads)
+		output.Threads = nil
+		msg = output
+	case output.Error != nil: // legacy callers have no way to receive an error
+		return fmt.Errorf(`legacy: %w`, output.Error)
+	default:
+		msg = ids(output.Threads)
+	}
+
+	// write result
+	if err := write(msg); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf(`encode: %w`, err)
+	}
+	return nil
+}
+
+// start traces the processing of req.
+func start(ctx context.Context, req domain.ThreadsRequest) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(``).Start(ctx, `processRequest`)
+	span.SetAttributes(attribute.Int(`limit`, int(req.Limit)))
+	span.SetAttributes(attribute.Int(`version`, int(req.Version)))
+	span.SetAttributes(attribute.StringSlice(`fields`, req.Fields))
+	span.SetAttributes(attribute.Bool(`paginated`, req.After != nil))
+	return ctx, span
+}
+
+// List serves req over gRPC, streaming like serve does.
+func (p processor) List(req *domain.ThreadsRequest, stream rpc.ThreadsStream) error {
+	req.Version = domain.ThreadsVersion
+	ctx, span := start(stream.Context(), *req)
+	defer span.End()
+	var emit func([]domain.Thread) error
+	if req.Chunk > 0 {
+		span.SetAttributes(attribute.Int(`chunk`, int(req.Chunk)))
+		emit = func(threads []domain.Thread) error {
+			return stream.Send(&domain.ThreadsResponse{Threads: threads, More: true})
+		}
+	}
+	output := p.respond(ctx, *req, emit)
+	if err := stream.Send(&output); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf(`send: %w`, err)
+	}
+	return nil
+}
+
+// handleThreads serves GET /threads?limit=&fields=&after= (fields defaults to all of them).
+func (p processor) handleThreads(r *http.Request) (any, *domain.Error) {
+	q := r.URL.Query()
+	req := domain.ThreadsRequest{Version: domain.ThreadsVersion, Fields: rest.List(q, `fields`)}
+	if _, ok := q[`fields`]; !ok {
+		req.Fields = []string{domain.FieldCreated}
+	}
+	var derr *domain.Error
+	if req.Limit, derr = rest.Int32(q, `limit`, 10); derr != nil {
+		return nil, derr
+	}
+	if raw := q.Get(`after`); raw != `` {
+		after, err := domain.ParseCursor(raw)
 		if err != nil {
-			span.RecordError(err)
-			span.End()
-			return fmt.Errorf(`process: %w`, err)
+			return nil, domain.NewError(r.Context(), err)
 		}
+		req.After = &after
+	}
+	ctx, span := start(r.Context(), req)
+	defer span.End()
+	output := p.respond(ctx, req, nil)
+	return output, output.Error
+}
 
-		// write result
-		if err := writer.Encode(output); err != nil {
-			span.RecordError(err)
-			span.End()
-			return fmt.Errorf(`encode: %w`, err)
+// respond queries the database for req, folding failures into the response so the connection stays open.
+// With emit, the response only holds the threads that were not emitted.
+func (p processor) respond(ctx context.Context, req domain.ThreadsRequest, emit func([]domain.Thread) error) domain.ThreadsResponse {
+	began := time.Now()
+	var output domain.ThreadsResponse
+	if req.Limit < 0 {
+		output.Error = &domain.Error{
+			Code:    domain.CodeInvalidArgument,
+			Message: fmt.Sprintf(`limit must be non-negative, got %d`, req.Limit),
 		}
-		span.End()
+	} else if threads, err := p.query(ctx, req, emit); err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		log.Printf(`process: %v`, err)
+		output.Error = domain.NewError(ctx, err)
+	} else {
+		output.Threads = threads
 	}
+	output.Duration = time.Since(began)
+	metrics.Requests.WithLabelValues(`threads`).Observe(output.Duration.Seconds())
+	return output
 }
 
-func (p processor) processRows(ctx context.Context, limit int32) ([]int32, error) {
-	rows, err := p.rowsParser.QueryContext(ctx, limit)
+// preallocate caps the capacity reserved for the threads of a query, as req.Limit is whatever the caller sent.
+const preallocate = 1 << 10
+
+// processRows reads the threads of req, passing every req.Chunk of them to emit (if set) as soon as they are
+// scanned. The threads that were not emitted are returned.
+func (p processor) processRows(ctx context.Context, req domain.ThreadsRequest, emit func([]domain.Thread) error) ([]domain.Thread, error) {
+	statement, query, args := `rows`, p.rowsParser, []any{req.Limit}
+	if req.After != nil {
+		created := sql.NullInt64{Int64: req.After.Created, Valid: req.After.HasCreated()}
+		statement, query, args = `page`, p.pageParser, append(args, created, req.After.ID)
+	}
+	size := req.Limit
+	if emit != nil && req.Chunk < size {
+		size = req.Chunk
+	}
+	stmt, cols, err := query.Stmt(ctx, req.Fields)
+	if err != nil {
+		return nil, err
+	}
+	began, emitting := time.Now(), time.Duration(0)
+	defer func() { // the chunks left are emitted by the caller, once rows are closed
+		metrics.Queries.WithLabelValues(statement).Observe((time.Since(began) - emitting).Seconds())
+	}()
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		return nil, fmt.Errorf(`query: %w`, err)
 	}
-	output := make([]int32, 0, limit)
+	defer rows.Close()
+	var (
+		output = make([]domain.Thread, 0, min(size, preallocate))
+		values = make([]sql.NullInt64, len(cols))
+		dest   = make([]any, 1+len(cols))
+	)
+	for i := range values {
+		dest[1+i] = &values[i]
+	}
 	for rows.Next() {
-		var id int32
-		if err := rows.Scan(&id); err != nil {
+		var thread domain.Thread
+		dest[0] = &thread.ID
+		if err := rows.Scan(dest...); err != nil {
 			return nil, fmt.Errorf(`scan: %w`, err)
 		}
-		output = append(output, id)
+		for i, col := range cols {
+			col.Set(&thread, values[i])
+		}
+		output = append(output, thread)
+		if emit != nil && int32(len(output)) == size {
+			sent := time.Now()
+			err := emit(output)
+			emitting += time.Since(sent) // time spent writing to the caller is not the query's
+			if err != nil {
+				return nil, fmt.Errorf(`emit: %w`, err)
+			}
+			output = make([]domain.Thread, 0, min(size, preallocate))
+		}
 	}
-	if err := rows.Close(); err != nil {
-		return nil, fmt.Errorf(`close: %w`, err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(`rows: %w`, err)
 	}
 	return output, nil
 }
@@ -136,8 +416,17 @@ func (p processor) processRows(ctx context.Context, limit int32) ([]int32, error
 // randomly is slower than `processRows` even though parsing is faster + easier
 func (p processor) processArray(ctx context.Context, limit int32) ([]int32, error) {
 	var list pq.Int32Array
+	defer prometheus.NewTimer(metrics.Queries.WithLabelValues(`arr`)).ObserveDuration()
 	if err := p.arrParser.QueryRowContext(ctx, limit).Scan(&list); err != nil {
 		return nil, fmt.Errorf(`query/scan: %w`, err)
 	}
 	return list, nil
 }
+
+func ids(threads []domain.Thread) []int32 {
+	out := make([]int32, len(threads))
+	for i, thread := range threads {
+		out[i] = thread.ID
+	}
+	return out
+}
@@ -2,19 +2,219 @@ package main
 
 import (
 	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+	"github.com/bign8/supergraph-top-n-challenge/lib/rest"
 )
 
+// expected results taken from the README "Test Cases / Examples"
+func TestProcessor(t *testing.T) {
+	p, err := newProcessor()
+	if err != nil {
+		t.Skip(err)
+		t.SkipNow()
+	}
+
+	subjects := map[string]func(ctx context.Context, limit int32) ([]int32, error){
+		`rows`:  p.processRowIDs,
+		`array`: p.processArray,
+	}
+	for name, subject := range subjects {
+		subject := subject
+		t.Run(name, func(t *testing.T) {
+			// Case 1
+			ids, err := subject(context.Background(), 1)
+			require.NoError(t, err)
+			assert.Equal(t, []int32{212991383}, ids)
+
+			// Case 2
+			ids, err = subject(context.Background(), 2)
+			require.NoError(t, err)
+			assert.Equal(t, []int32{212991383, 1194533456}, ids)
+		})
+	}
+
+	t.Run(`created`, func(t *testing.T) {
+		threads, err := p.processRows(context.Background(), domain.ThreadsRequest{Limit: 2, Fields: []string{domain.FieldCreated}}, nil)
+		require.NoError(t, err)
+		require.Len(t, threads, 2)
+		assert.Equal(t, int32(212991383), threads[0].ID)
+		assert.False(t, threads[0].Created.IsZero())
+		assert.False(t, threads[1].Created.After(threads[0].Created), `newest first`)
+	})
+
+	t.Run(`null created`, func(t *testing.T) {
+		nullThread(t, p)
+		threads, err := p.processRows(context.Background(), domain.ThreadsRequest{Limit: 2, Fields: []string{domain.FieldCreated}}, nil)
+		require.NoError(t, err)
+		require.Len(t, threads, 2)
+		assert.Equal(t, domain.Thread{ID: nullThreadID}, threads[0], `NULLs first, as in threads_created_idx`)
+		assert.Equal(t, int32(212991383), threads[1].ID)
+
+		after := domain.NewCursor(threads[0].Created, threads[0].ID)
+		next, err := p.processRows(context.Background(), domain.ThreadsRequest{Limit: 1, After: &after}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []int32{212991383}, ids(next), `paged past`)
+	})
+
+	t.Run(`stream`, func(t *testing.T) {
+		var chunks [][]int32
+		rest, err := p.processRows(context.Background(), domain.ThreadsRequest{Limit: 5, Chunk: 2}, func(threads []domain.Thread) error {
+			chunks = append(chunks, ids(threads))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, chunks, 2)
+		assert.Len(t, rest, 1)
+		assert.Equal(t, []int32{212991383, 1194533456}, chunks[0])
+	})
+
+	t.Run(`huge limit`, func(t *testing.T) { // e.g. GET /threads?limit=2147483647
+		threads, err := p.processRows(context.Background(), domain.ThreadsRequest{Limit: math.MaxInt32}, nil)
+		require.NoError(t, err)
+		assert.NotEmpty(t, threads)
+	})
+
+	t.Run(`after`, func(t *testing.T) {
+		first, err := p.processRows(context.Background(), domain.ThreadsRequest{Limit: 1, Fields: []string{domain.FieldCreated}}, nil)
+		require.NoError(t, err)
+		require.Len(t, first, 1)
+		after := domain.NewCursor(first[0].Created, first[0].ID)
+		next, err := p.processRows(context.Background(), domain.ThreadsRequest{Limit: 1, After: &after}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []int32{1194533456}, ids(next))
+	})
+}
+
+// nullThreadID is not in db/threads.sql.
+const nullThreadID = math.MaxInt32
+
+// nullThread adds a thread without created for the duration of the test.
+func nullThread(t *testing.T, p *processor) {
+	_, err := p.db.Exec(`INSERT INTO threads (id, created) VALUES ($1, NULL);`, nullThreadID)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, err := p.db.Exec(`DELETE FROM threads WHERE id = $1;`, nullThreadID)
+		assert.NoError(t, err)
+	})
+}
+
+func TestProcessVersions(t *testing.T) {
+	created := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	p := processor{query: func(_ context.Context, req domain.ThreadsRequest, _ func([]domain.Thread) error) ([]domain.Thread, error) {
+		return []domain.Thread{{ID: 7, Created: created}, {ID: 8, Created: created}}[:req.Limit], nil
+	}}
+	server, client := net.Pipe()
+	done := make(chan error)
+	go func() { done <- p.process(server) }()
+	enc, dec := gob.NewEncoder(client), gob.NewDecoder(client)
+
+	require.NoError(t, enc.Encode(domain.ThreadsRequest{ID: 1, Limit: 2}))
+	var legacy []int32
+	require.NoError(t, dec.Decode(&legacy))
+	assert.Equal(t, []int32{7, 8}, legacy, `version 0 callers get bare IDs`)
+
+	require.NoError(t, enc.Encode(domain.ThreadsRequest{ID: 2, Limit: 1, Version: 1}))
+	var res domain.ThreadsResponse
+	require.NoError(t, dec.Decode(&res))
+	assert.Equal(t, uint64(2), res.ID)
+	assert.Equal(t, []int32{7}, res.IDs)
+	assert.Nil(t, res.Threads)
+
+	require.NoError(t, enc.Encode(domain.ThreadsRequest{ID: 3, Limit: 1, Version: domain.ThreadsVersion}))
+	res = domain.ThreadsResponse{}
+	require.NoError(t, dec.Decode(&res))
+	assert.Equal(t, uint64(3), res.ID)
+	assert.Nil(t, res.IDs)
+	assert.Equal(t, []domain.Thread{{ID: 7, Created: created}}, res.Threads)
+
+	require.NoError(t, enc.Encode(domain.ThreadsRequest{ID: 4, Limit: 1, Version: 1}))
+	require.NoError(t, enc.Encode(domain.ThreadsRequest{ID: 5, Limit: -1, Version: 1}))
+	got := map[uint64]*domain.Error{}
+	for i := 0; i < 2; i++ {
+		res = domain.ThreadsResponse{}
+		require.NoError(t, dec.Decode(&res))
+		got[res.ID] = res.Error
+	}
+	assert.Nil(t, got[4])
+	require.NotNil(t, got[5], `version 1 callers get errors in the envelope`)
+	assert.Equal(t, domain.CodeInvalidArgument, got[5].Code)
+
+	// a bare []int32 has no room for an error: the connection is dropped instead
+	require.NoError(t, enc.Encode(domain.ThreadsRequest{ID: 6, Limit: -1}))
+	assert.ErrorIs(t, dec.Decode(&legacy), io.EOF)
+	client.Close()
+	assert.Error(t, <-done)
+}
+
+func TestHTTP(t *testing.T) {
+	var got domain.ThreadsRequest
+	p := processor{query: func(_ context.Context, req domain.ThreadsRequest, _ func([]domain.Thread) error) ([]domain.Thread, error) {
+		got = req
+		return []domain.Thread{{ID: 7, Created: time.Unix(0, 0).UTC()}}, nil
+	}}
+	h := rest.Handle(p.handleThreads)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/threads?limit=1`, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, domain.ThreadsRequest{
+		Limit:   1,
+		Version: domain.ThreadsVersion,
+		Fields:  []string{domain.FieldCreated}, // all of them by default
+	}, got)
+	var res domain.ThreadsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, []domain.Thread{{ID: 7, Created: time.Unix(0, 0).UTC()}}, res.Threads)
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/threads?fields=`, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(10), got.Limit, `default limit`)
+	assert.Empty(t, got.Fields)
+	assert.Nil(t, got.After)
+
+	after := domain.Cursor{Created: 1, ID: 7}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/threads?fields=created&after=`+after.String(), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{domain.FieldCreated}, got.Fields)
+	assert.Equal(t, &after, got.After)
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/threads?after=nope`, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `invalid cursor`)
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/threads?limit=ten`, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func (p processor) processRowIDs(ctx context.Context, limit int32) ([]int32, error) {
+	threads, err := p.processRows(ctx, domain.ThreadsRequest{Limit: limit}, nil)
+	return ids(threads), err
+}
+
 func BenchmarkProcessRows(b *testing.B) {
 	p, err := newProcessor()
 	if err != nil {
 		b.Skip(err)
 		b.SkipNow()
 	}
-	benchmark(b, p.processRows)
+	benchmark(b, p.processRowIDs)
 }
 
 func BenchmarkProcessArray(b *testing.B) {
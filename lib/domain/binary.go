@@ -0,0 +1,205 @@
+package domain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// PackedRecords holds PostsResponse.Records in a compact binary encoding, which gob uses in place of its own:
+// gob would describe the map, allocate per key and per post, and re-send its type information on every
+// connection. Only callers sending PostsPackedVersion are answered with it, so plain gob stays the default.
+//
+// All integers are little endian:
+//
+//	flags    byte (packedCreated)
+//	records  uint32 thread count, then per thread:
+//	           int32 thread ID, uint32 post count, the posts' IDs as packed int32s,
+//	           and their Created as packed unix micros (int64, noCreated if zero) if packedCreated
+//
+// A post's ThreadID is not sent: decoding sets it to the thread the post is listed under.
+type PackedRecords map[int32][]Post
+
+const packedCreated = 1
+
+const noCreated = math.MinInt64
+
+var errShortRecords = errors.New(`domain: PackedRecords: short buffer`)
+
+// MarshalBinary encodes r (see AppendBinary) into a new buffer of its exact size, allocating once.
+func (r PackedRecords) MarshalBinary() ([]byte, error) {
+	created := r.hasCreated()
+	return r.appendBinary(make([]byte, 0, r.binarySize(created)), created), nil
+}
+
+// AppendBinary appends the binary encoding of r to b, so callers can reuse a buffer: once b has grown to fit,
+// encoding allocates nothing.
+func (r PackedRecords) AppendBinary(b []byte) []byte {
+	created := r.hasCreated()
+	if need := r.binarySize(created); cap(b)-len(b) < need {
+		b = append(make([]byte, 0, len(b)+need), b...)
+	}
+	return r.appendBinary(b, created)
+}
+
+// appendBinary appends the encoding of r to b, with Created iff created (see hasCreated).
+func (r PackedRecords) appendBinary(b []byte, created bool) []byte {
+	var flags byte
+	if created {
+		flags |= packedCreated
+	}
+	b = append(b, flags)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(r)))
+	for thread, posts := range r {
+		b = binary.LittleEndian.AppendUint32(b, uint32(thread))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(posts)))
+		for _, post := range posts {
+			b = binary.LittleEndian.AppendUint32(b, uint32(post.ID))
+		}
+		if created {
+			for _, post := range posts {
+				micros := int64(noCreated)
+				if !post.Created.IsZero() {
+					micros = post.Created.UnixMicro()
+				}
+				b = binary.LittleEndian.AppendUint64(b, uint64(micros))
+			}
+		}
+	}
+	return b
+}
+
+// hasCreated reports whether any post of r has Created set, so the encoding carries them.
+func (r PackedRecords) hasCreated() bool {
+	for _, posts := range r {
+		for _, post := range posts {
+			if !post.Created.IsZero() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// binarySize is the length of r's binary encoding, with Created iff created.
+func (r PackedRecords) binarySize(created bool) int {
+	perPost := 4
+	if created {
+		perPost += 8
+	}
+	size := 1 + 4
+	for _, posts := range r {
+		size += 8 + perPost*len(posts)
+	}
+	return size
+}
+
+// PackedResponse is a PostsResponse whose Packed records are already encoded, so services can pack them with
+// AppendBinary into a buffer reused across responses. gob only checks that Packed is sent by a MarshalBinary,
+// so callers decode it as the PostsResponse it stands for; other codecs would not, and get PostsResponse.
+type PackedResponse struct {
+	ID     uint64
+	Packed packedBytes
+	Error  *Error
+}
+
+// packedBytes are sent as is: gob copies them out, so the buffer can be reused once Encode returns.
+type packedBytes []byte
+
+func (b packedBytes) MarshalBinary() ([]byte, error) {
+	return b, nil
+}
+
+// UnmarshalBinary decodes data (see AppendBinary) into a new map, with one allocation for all of the posts.
+func (r *PackedRecords) UnmarshalBinary(data []byte) error {
+	d := decoder{data: data}
+	perPost := 4
+	if d.byte()&packedCreated != 0 {
+		perPost += 8
+	}
+	threads := int(d.uint32())
+	if !d.fits(threads, 8) {
+		return d.err
+	}
+	var out PackedRecords
+	var all []Post
+	if threads > 0 {
+		out = make(PackedRecords, threads)
+		all = make([]Post, (len(d.data)-8*threads)/perPost) // exact for well-formed data, checked below
+	}
+	for i := 0; i < threads && d.err == nil; i++ {
+		thread := int32(d.uint32())
+		n := int(d.uint32())
+		if !d.fits(n, perPost) || len(all) < n {
+			d.err = errShortRecords
+			break
+		}
+		posts := all[:n:n]
+		all = all[n:]
+		for j := range posts {
+			posts[j] = Post{ID: int32(d.uint32()), ThreadID: thread}
+		}
+		if perPost > 4 {
+			for j := range posts {
+				if micros := int64(d.uint64()); micros != noCreated {
+					posts[j].Created = time.UnixMicro(micros).UTC()
+				}
+			}
+		}
+		out[thread] = posts
+	}
+	if d.err == nil && len(d.data) > 0 {
+		d.err = fmt.Errorf(`domain: PackedRecords: %d trailing bytes`, len(d.data))
+	}
+	if d.err != nil {
+		return d.err
+	}
+	*r = out
+	return nil
+}
+
+// decoder reads data, recording the first error; reads after it return zeros.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fits(n, size int) bool {
+	if d.err == nil && (n < 0 || len(d.data)/size < n) {
+		d.err = errShortRecords
+	}
+	return d.err == nil
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || len(d.data) < n {
+		d.err = errShortRecords
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
@@ -0,0 +1,161 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackedRecordsBinary(t *testing.T) {
+	created := time.UnixMicro(1700000000123456).UTC()
+	for name, records := range map[string]PackedRecords{
+		`created`: {
+			1:  {{ID: 10, ThreadID: 1, Created: created}, {ID: -11, ThreadID: 1}},
+			-2: {},
+		},
+		`ids`:   {3: {{ID: 30, ThreadID: 3}, {ID: 31, ThreadID: 3}}, 4: {{ID: 40, ThreadID: 4}}},
+		`empty`: nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, err := records.MarshalBinary()
+			require.NoError(t, err)
+			assert.Equal(t, records.binarySize(records.hasCreated()), cap(b), `allocated once`)
+			appended := records.AppendBinary([]byte{0xff})
+			assert.Equal(t, byte(0xff), appended[0], `kept what was there`)
+			var again PackedRecords
+			require.NoError(t, again.UnmarshalBinary(appended[1:]))
+			assert.Equal(t, records, again)
+			buf := make([]byte, 0, len(b))
+			assert.Zero(t, testing.AllocsPerRun(10, func() { buf = records.AppendBinary(buf[:0]) }), `reusing buf`)
+
+			var got PackedRecords
+			require.NoError(t, got.UnmarshalBinary(b))
+			assert.Equal(t, records, got)
+
+			for i := range b { // truncated
+				assert.Error(t, new(PackedRecords).UnmarshalBinary(b[:i]), `%d bytes`, i)
+			}
+			assert.Error(t, new(PackedRecords).UnmarshalBinary(append(b, 0)), `trailing byte`)
+		})
+	}
+
+	t.Run(`thread`, func(t *testing.T) {
+		b, err := PackedRecords{7: {{ID: 1, ThreadID: 8}}}.MarshalBinary()
+		require.NoError(t, err)
+		var got PackedRecords
+		require.NoError(t, got.UnmarshalBinary(b))
+		assert.Equal(t, PackedRecords{7: {{ID: 1, ThreadID: 7}}}, got, `ThreadID is the thread the post is listed under`)
+	})
+}
+
+func TestPostsResponseGob(t *testing.T) {
+	records := map[int32][]Post{1: {{ID: 10, ThreadID: 1, Created: time.Unix(0, 0).UTC()}}}
+	for _, res := range []PostsResponse{
+		{ID: 7, Records: records},
+		{ID: 8, Packed: records},
+		{ID: 9, Error: &Error{Code: CodeInternal, Message: `boom`}},
+	} {
+		var buf bytes.Buffer
+		require.NoError(t, gob.NewEncoder(&buf).Encode(res))
+		var got PostsResponse
+		require.NoError(t, gob.NewDecoder(&buf).Decode(&got))
+		assert.Equal(t, res, got)
+	}
+}
+
+func TestPackedResponseGob(t *testing.T) {
+	var buf bytes.Buffer
+	enc, dec := gob.NewEncoder(&buf), gob.NewDecoder(&buf)
+	var packed []byte
+	for i, records := range []PackedRecords{{1: {{ID: 10, ThreadID: 1, Created: time.Unix(0, 0).UTC()}}}, {2: {{ID: 20, ThreadID: 2}}}} {
+		packed = records.AppendBinary(packed[:0])
+		require.NoError(t, enc.Encode(PackedResponse{ID: uint64(i), Packed: packed}))
+		require.NoError(t, enc.Encode(PostsResponse{ID: 9, Error: &Error{Code: CodeInternal, Message: `boom`}}))
+
+		var got PostsResponse
+		require.NoError(t, dec.Decode(&got))
+		assert.Equal(t, PostsResponse{ID: uint64(i), Packed: records}, got)
+		got = PostsResponse{}
+		require.NoError(t, dec.Decode(&got), `both types on one stream`)
+		assert.Equal(t, uint64(9), got.ID)
+	}
+}
+
+// BenchmarkPostsResponse compares the binary encoding of threads x posts records, into a new buffer per message
+// (marshal) and with one buffer reused across messages (marshal-append), to gob carrying the records as
+// PostsResponse.Records (plain gob), as PostsResponse.Packed and as a PackedResponse packed into a reused
+// buffer (gob-append), over one stream as a connection would.
+func BenchmarkPostsResponse(b *testing.B) {
+	for _, shape := range []struct{ threads, posts int }{{4, 20}, {100, 100}} {
+		records := make(PackedRecords, shape.threads)
+		for thread := int32(0); thread < int32(shape.threads); thread++ {
+			posts := make([]Post, shape.posts)
+			for i := range posts {
+				posts[i] = Post{ID: 1_000_000_000 + thread*int32(shape.posts) + int32(i), ThreadID: 1_000_000_000 + thread}
+			}
+			records[1_000_000_000+thread] = posts
+		}
+		name := fmt.Sprintf(`%dx%d`, shape.threads, shape.posts)
+
+		b.Run(name+`/marshal`, func(b *testing.B) {
+			var buf []byte
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf, _ = records.MarshalBinary()
+			}
+			b.ReportMetric(float64(len(buf)), `bytes/msg`)
+		})
+		b.Run(name+`/marshal-append`, func(b *testing.B) {
+			buf := records.AppendBinary(nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf = records.AppendBinary(buf[:0])
+			}
+		})
+		b.Run(name+`/unmarshal`, func(b *testing.B) {
+			data, _ := records.MarshalBinary()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var out PackedRecords
+				if err := out.UnmarshalBinary(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		var packed []byte // reused by gob-append, as the posts service does
+		for _, gobbed := range []struct {
+			name string
+			res  func() any
+		}{
+			{`gob`, func() any { return PostsResponse{ID: 1, Records: records} }},
+			{`gob-packed`, func() any { return PostsResponse{ID: 1, Packed: records} }},
+			{`gob-append`, func() any {
+				packed = records.AppendBinary(packed[:0])
+				return PackedResponse{ID: 1, Packed: packed}
+			}},
+		} {
+			b.Run(name+`/`+gobbed.name, func(b *testing.B) {
+				var buf bytes.Buffer
+				enc, dec := gob.NewEncoder(&buf), gob.NewDecoder(&buf)
+				var sent int
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if err := enc.Encode(gobbed.res()); err != nil {
+						b.Fatal(err)
+					}
+					sent += buf.Len()
+					var out PostsResponse
+					if err := dec.Decode(&out); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(sent)/float64(b.N), `bytes/msg`)
+			})
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Cursor is a keyset position in a newest first (created DESC, id DESC) listing: the last record seen.
+// Records without created (NULL, a zero Created) are listed first, as Postgres sorts NULLs in DESC order.
+type Cursor struct {
+	Created int64 // unix microseconds, NullCreated for a record without created
+	ID      int32
+}
+
+// NullCreated is the Cursor.Created of a record whose created is NULL.
+const NullCreated = math.MinInt64
+
+func NewCursor(created time.Time, id int32) Cursor {
+	if created.IsZero() {
+		return Cursor{Created: NullCreated, ID: id}
+	}
+	return Cursor{Created: created.UnixMicro(), ID: id}
+}
+
+// HasCreated tells whether the record at c had a created, else only records without one precede it.
+func (c Cursor) HasCreated() bool {
+	return c.Created != NullCreated
+}
+
+// String encodes c for clients, who should treat it as opaque.
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, `%d:%d`, c.Created, c.ID))
+}
+
+// ParseCursor decodes a Cursor.String, reporting malformed input as CodeInvalidArgument.
+func ParseCursor(s string) (Cursor, error) {
+	var c Cursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		_, err = fmt.Sscanf(string(raw), `%d:%d`, &c.Created, &c.ID)
+	}
+	if err != nil {
+		return c, &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf(`invalid cursor %q`, s)}
+	}
+	return c, nil
+}
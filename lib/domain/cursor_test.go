@@ -0,0 +1,30 @@
+package domain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor(t *testing.T) {
+	c := NewCursor(time.Date(2022, 8, 5, 8, 7, 44, 977826000, time.UTC), 760694634)
+	parsed, err := ParseCursor(c.String())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+	assert.True(t, c.HasCreated())
+
+	c = NewCursor(time.Time{}, 7) // created is NULL
+	assert.False(t, c.HasCreated())
+	parsed, err = ParseCursor(c.String())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	for _, bad := range []string{``, `!!`, `MTIz`} {
+		_, err := ParseCursor(bad)
+		var derr *Error
+		require.ErrorAs(t, err, &derr, bad)
+		assert.Equal(t, CodeInvalidArgument, derr.Code)
+	}
+}
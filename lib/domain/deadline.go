@@ -0,0 +1,41 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// HeaderTimeout carries the caller's remaining time budget in request Headers, formatted as a
+// time.Duration. It is relative rather than absolute so clock skew between hosts doesn't matter.
+const HeaderTimeout = `timeout`
+
+// InjectDeadline records the time left before ctx's deadline (if any) in headers.
+func InjectDeadline(ctx context.Context, headers map[string]string) {
+	if deadline, ok := ctx.Deadline(); ok {
+		headers[HeaderTimeout] = time.Until(deadline).String()
+	}
+}
+
+// ExtractDeadline bounds ctx by the timeout found in headers, if any.
+func ExtractDeadline(ctx context.Context, headers map[string]string) (context.Context, context.CancelFunc) {
+	if raw, ok := headers[HeaderTimeout]; ok {
+		if timeout, err := time.ParseDuration(raw); err == nil {
+			return context.WithTimeout(ctx, timeout)
+		}
+	}
+	return context.WithCancel(ctx)
+}
+
+// NewError describes a failure to process a request bounded by ctx, passing through any *Error in err's chain.
+func NewError(ctx context.Context, err error) *Error {
+	var derr *Error
+	if errors.As(err, &derr) {
+		return derr
+	}
+	code := CodeInternal
+	if ctx.Err() == context.DeadlineExceeded {
+		code = CodeDeadlineExceeded
+	}
+	return &Error{Code: code, Message: err.Error()}
+}
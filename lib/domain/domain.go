@@ -1,18 +1,97 @@
 package domain
 
+import "time"
+
+// Error codes carried in Error.Code.
+const (
+	CodeInvalidArgument  = `INVALID_ARGUMENT`
+	CodeInternal         = `INTERNAL`
+	CodeDeadlineExceeded = `DEADLINE_EXCEEDED`
+	CodeUnavailable      = `UNAVAILABLE` // set by callers when the service could not be reached
+)
+
+// Error is a per-request failure reported back to the caller on the wire.
+// A response with a non-nil Error carries no other data, but the connection stays usable.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + `: ` + e.Message
+}
+
+// Thread is a row of the threads table.
+type Thread struct {
+	ID      int32     `json:"id"`
+	Created time.Time `json:"created"` // FieldCreated
+}
+
+// Post is a row of the posts table.
+type Post struct {
+	ID       int32     `json:"id"`
+	ThreadID int32     `json:"threadId"`
+	Created  time.Time `json:"created"` // FieldCreated
+}
+
+// Fields that may be requested in ThreadsRequest.Fields and PostsRequest.Fields. IDs (and a post's ThreadID)
+// are always returned; anything else is left zero unless requested.
+const (
+	FieldCreated = `created`
+)
+
+// ThreadsVersion is sent in ThreadsRequest.Version by callers that decode a ThreadsResponse.
+// Older gateways keep working mid-rollout: requests without a version are answered with a bare []int32,
+// and version 1 requests get ThreadsResponse.IDs instead of ThreadsResponse.Threads.
+const ThreadsVersion = 2
+
+// ThreadsRequest asks for the newest Limit threads, older than After if set. ID is assigned by the caller
+// and echoed on the ThreadsResponse, so one connection can carry many requests that are answered out of order.
 type ThreadsRequest struct {
+	ID      uint64
 	Limit   int32
+	Version int32
+	Fields  []string // projection, see FieldCreated
+	After   *Cursor  // keyset pagination
+	Chunk   int32    // optional: stream the threads in frames of at most Chunk (see ThreadsResponse.More)
 	Headers map[string]string
+	Ping    bool // health check: answered right away by an empty ThreadsResponse, without querying
+}
+
+type ThreadsResponse struct {
+	ID       uint64        `json:"id,omitempty"`      // of the ThreadsRequest
+	IDs      []int32       `json:"ids,omitempty"`     // version 1 only
+	Threads  []Thread      `json:"threads,omitempty"` // version 2+
+	Error    *Error        `json:"error,omitempty"`
+	Duration time.Duration `json:"durationNs"`     // time spent by the service producing the response
+	More     bool          `json:"more,omitempty"` // streaming: more frames follow; the last one (More unset) carries Error and Duration
 }
 
-// type ThreadsResponse []int32
+// PostsVersion is sent in PostsRequest.Version by callers that decode PostsResponse.Records; requests
+// without it are answered with PostsResponse.Posts. Callers sending PostsPackedVersion get
+// PostsResponse.Packed instead of Records.
+const (
+	PostsVersion       = 1
+	PostsPackedVersion = 2
+)
 
+// PostsRequest asks for the newest Limit posts of each thread, older than the thread's After cursor if any.
+// ID works like ThreadsRequest.ID.
 type PostsRequest struct {
+	ID      uint64
 	Limit   int32
 	Threads []int32
+	Version int32
+	Fields  []string         // projection, see FieldCreated
+	After   map[int32]Cursor // keyset pagination, by thread
 	Headers map[string]string
+	Ping    bool // like ThreadsRequest.Ping
 }
 
 type PostsResponse struct {
-	Posts map[int32][]int32
+	ID      uint64            `json:"id,omitempty"`      // of the PostsRequest
+	Posts   map[int32][]int32 `json:"posts,omitempty"`   // version 0 only
+	Records map[int32][]Post  `json:"records,omitempty"` // version 1+, keyed by thread
+	Packed  PackedRecords     `json:"packed,omitempty"`  // version 2+: Records, moved here by services that know it
+	Error   *Error            `json:"error,omitempty"`
 }
@@ -0,0 +1,159 @@
+// Package graceful stops servers without dropping the requests they are serving: on SIGINT or SIGTERM, they stop
+// accepting, drain what is in flight within a deadline, then release their resources.
+package graceful
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Signal returns a context canceled on the first SIGINT or SIGTERM; a second one kills the process as usual.
+func Signal() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// Stop runs every stop func concurrently, sharing ctx (their deadline), and joins their errors.
+func Stop(ctx context.Context, stops ...func(context.Context) error) error {
+	errs := make([]error, len(stops))
+	var wg sync.WaitGroup
+	for i, stop := range stops {
+		wg.Add(1)
+		go func(i int, stop func(context.Context) error) {
+			defer wg.Done()
+			errs[i] = stop(ctx)
+		}(i, stop)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Server serves long lived connections (the gob protocol) with Handle, which reads requests until the
+// connection's reads fail and returns once the requests it read are answered.
+//
+// Shutdown makes the pending read of every connection fail (with os.ErrDeadlineExceeded), so each Handle
+// answers what it already read and returns; connections still open at the deadline are closed.
+type Server struct {
+	Handle func(net.Conn) error
+
+	mu        sync.Mutex // guards everything below
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closing   bool
+	wg        sync.WaitGroup // one per conn
+}
+
+// Serve accepts connections from l until Shutdown, which makes it return nil.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		l.Close()
+		return nil
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return nil
+			}
+			return err
+		}
+		log.Printf(`received connection: %v`, conn.RemoteAddr())
+		if !s.add(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.remove(conn)
+			err := s.Handle(conn)
+			switch {
+			case err == nil:
+			case s.shuttingDown() && errors.Is(err, os.ErrDeadlineExceeded):
+				log.Printf(`closing connection: %v (shutting down)`, conn.RemoteAddr())
+			default:
+				log.Printf(`dropping connection %v: %v`, conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Shutdown stops accepting, then waits for every connection to be drained, closing them all if ctx ends first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	var errs []error
+	for l := range s.listeners {
+		errs = append(errs, l.Close())
+	}
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now()) // writes of in-flight responses still go through
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		errs = append(errs, ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) add(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) remove(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
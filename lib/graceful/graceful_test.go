@@ -0,0 +1,106 @@
+package graceful
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echo answers each line read after release is closed, like a service answering requests out of band.
+func echo(release <-chan struct{}) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		defer conn.Close()
+		var inflight sync.WaitGroup
+		defer inflight.Wait()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf(`decode: %w`, err)
+			}
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				<-release
+				conn.Write([]byte(line))
+			}()
+		}
+	}
+}
+
+func serve(t *testing.T, s *Server) string {
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	require.NoError(t, err)
+	go func() { assert.NoError(t, s.Serve(l)) }()
+	return l.Addr().String()
+}
+
+func TestShutdownDrains(t *testing.T) {
+	release := make(chan struct{})
+	s := &Server{Handle: echo(release)}
+	addr := serve(t, s)
+
+	conn, err := net.Dial(`tcp`, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond) // read by the server
+
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf(`shut down with a request in flight: %v`, err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, err = net.Dial(`tcp`, addr)
+	assert.Error(t, err, `stopped accepting`)
+
+	close(release)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line, `in-flight request answered`)
+	assert.NoError(t, <-done)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s := &Server{Handle: echo(nil)} // never answers
+	addr := serve(t, s)
+
+	conn, err := net.Dial(`tcp`, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err, `connection closed`)
+}
+
+func TestStop(t *testing.T) {
+	var mu sync.Mutex
+	var stopped []int
+	stop := func(i int, err error) func(context.Context) error {
+		return func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			stopped = append(stopped, i)
+			return err
+		}
+	}
+	err := Stop(context.Background(), stop(1, nil), stop(2, assert.AnError))
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.ElementsMatch(t, []int{1, 2}, stopped)
+}
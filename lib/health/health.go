@@ -0,0 +1,85 @@
+// Package health serves liveness (/healthz) and readiness (/readyz) probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check reports why a dependency is not usable, if it is not.
+type Check func(ctx context.Context) error
+
+// Timeout bounds a readiness probe; checks still running after it fail.
+var Timeout = time.Second
+
+// Register serves /healthz, answered as long as the process is, and /readyz, which runs every check
+// concurrently and answers 503 unless all of them pass. Both reply with the outcome of each check by name.
+func Register(mux *http.ServeMux, checks map[string]Check) {
+	mux.HandleFunc(`/healthz`, func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, map[string]string{`process`: `ok`})
+	})
+	mux.HandleFunc(`/readyz`, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+		defer cancel()
+		results, ok := Run(ctx, checks)
+		status := http.StatusOK
+		if !ok {
+			status = http.StatusServiceUnavailable
+		}
+		reply(w, status, results)
+	})
+}
+
+// Until passes until ctx is done (see graceful.Signal), so a draining process stops receiving new traffic.
+func Until(ctx context.Context) Check {
+	return func(context.Context) error {
+		if ctx.Err() != nil {
+			return errShuttingDown
+		}
+		return nil
+	}
+}
+
+var errShuttingDown = errors.New(`shutting down`)
+
+// Run runs checks concurrently, returning `ok` or the error of each by name, and whether all of them passed.
+func Run(ctx context.Context, checks map[string]Check) (map[string]string, bool) {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			errs[i] = check(ctx)
+		}(i, checks[name])
+	}
+	wg.Wait()
+
+	results := make(map[string]string, len(names))
+	ok := true
+	for i, name := range names {
+		results[name] = `ok`
+		if errs[i] != nil {
+			results[name] = errs[i].Error()
+			ok = false
+		}
+	}
+	return results, ok
+}
+
+func reply(w http.ResponseWriter, status int, results map[string]string) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.Header().Set(`Cache-Control`, `no-store`)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,54 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(mux *http.ServeMux, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestRegister(t *testing.T) {
+	var dbErr error
+	serving, stop := context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	Register(mux, map[string]Check{
+		`db`:      func(context.Context) error { return dbErr },
+		`serving`: Until(serving),
+	})
+
+	w := probe(mux, `/readyz`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"db": "ok", "serving": "ok"}`, w.Body.String())
+
+	dbErr = errors.New(`dial tcp: connection refused`)
+	stop()
+	w = probe(mux, `/readyz`)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"db": "dial tcp: connection refused", "serving": "shutting down"}`, w.Body.String())
+
+	w = probe(mux, `/healthz`)
+	assert.Equal(t, http.StatusOK, w.Code, `alive regardless of dependencies`)
+}
+
+func TestRunTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	results, ok := Run(ctx, map[string]Check{
+		`hung`: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	assert.False(t, ok)
+	assert.Equal(t, map[string]string{`hung`: context.DeadlineExceeded.Error()}, results)
+}
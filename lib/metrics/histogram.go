@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+const scope = `github.com/bign8/supergraph-top-n-challenge/lib/metrics`
+
+// meter creates the OpenTelemetry instruments; they record nothing until tracing.Init sets a meter provider.
+var meter = otel.Meter(scope)
+
+// views give every OpenTelemetry histogram the buckets of its Prometheus counterpart (see Views).
+var views []sdkmetric.View
+
+// Views are to be registered on the meter provider (tracing.Init does), as the default buckets of the SDK
+// (0, 5, 10, 25, ... 10000) would put nearly every latency, in seconds, in the first one.
+func Views() []sdkmetric.View {
+	return views
+}
+
+// Histogram records to a Prometheus histogram and to the OpenTelemetry histogram of the same name (with dots:
+// supergraph.request_duration_seconds), so either backend sees every observation.
+type Histogram struct {
+	prom   *prometheus.HistogramVec
+	otel   metric.Float64Histogram
+	labels []string
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) Histogram {
+	prom := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	}, labels)
+	prometheus.MustRegister(prom)
+	unit := `1`
+	if strings.HasSuffix(name, `_seconds`) {
+		unit = `s`
+	}
+	views = append(views, sdkmetric.NewView(
+		sdkmetric.Instrument{Name: namespace + `.` + name, Scope: instrumentation.Scope{Name: scope}},
+		sdkmetric.Stream{Aggregation: sdkmetric.AggregationExplicitBucketHistogram{Boundaries: buckets}},
+	))
+	h, err := meter.Float64Histogram(namespace+`.`+name,
+		metric.WithDescription(help),
+		metric.WithUnit(unit),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	return Histogram{prom: prom, otel: h, labels: labels}
+}
+
+// WithLabelValues returns the observer of the given label values, in the order the labels were declared.
+func (h Histogram) WithLabelValues(values ...string) Observer {
+	attrs := make([]attribute.KeyValue, len(values))
+	for i, v := range values {
+		attrs[i] = attribute.String(h.labels[i], v)
+	}
+	return Observer{
+		prom:  h.prom.WithLabelValues(values...),
+		otel:  h.otel,
+		attrs: metric.WithAttributeSet(attribute.NewSet(attrs...)),
+	}
+}
+
+// Observe records v on a histogram without labels.
+func (h Histogram) Observe(v float64) { h.WithLabelValues().Observe(v) }
+
+// Observer records to both backends; it is a prometheus.Observer, so prometheus.NewTimer can time with it.
+type Observer struct {
+	prom  prometheus.Observer
+	otel  metric.Float64Histogram
+	attrs metric.RecordOption
+}
+
+func (o Observer) Observe(v float64) {
+	o.prom.Observe(v)
+	if o.otel != nil {
+		o.otel.Record(context.Background(), v, o.attrs)
+	}
+}
@@ -0,0 +1,112 @@
+// Package metrics exposes Prometheus metrics on /metrics, so latencies can be watched while load runs. The same
+// measurements are recorded as OpenTelemetry metrics, exported next to the traces (see tracing.Init).
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/pool"
+)
+
+const namespace = `supergraph`
+
+// latency buckets from 50µs to ~3s: requests take single digit milliseconds, messages and queries less
+var latency = prometheus.ExponentialBuckets(50e-6, 2, 17)
+
+var (
+	// Requests times the requests served, by operation (the GraphQL operation on the gateway).
+	Requests = newHistogram(`request_duration_seconds`, `Time to answer a request, by operation.`,
+		latency, `operation`)
+
+	// BatchSize counts the posts keys per dataloader batch.
+	BatchSize = newHistogram(`loader_batch_size`, `Posts keys dispatched per dataloader batch.`,
+		prometheus.ExponentialBuckets(1, 2, 10))
+
+	// BatchWait times how long the first key of a dataloader batch waited for the batch to be dispatched.
+	BatchWait = newHistogram(`loader_batch_wait_seconds`, `Time from the first Load of a dataloader batch to its dispatch.`,
+		prometheus.ExponentialBuckets(1e-6, 4, 12))
+
+	// Wire times messages of the gob protocol, by codec and op (encode or decode).
+	Wire = newHistogram(`wire_duration_seconds`, `Time to encode or decode a message of the gob protocol, by codec.`,
+		prometheus.ExponentialBuckets(1e-6, 4, 12), `codec`, `op`)
+
+	// Queries times database queries until their rows are read, by prepared statement.
+	Queries = newHistogram(`db_query_duration_seconds`, `Time to run a query and read its rows, by prepared statement.`,
+		latency, `statement`)
+)
+
+// Register serves the metrics on /metrics.
+func Register(mux *http.ServeMux) {
+	mux.Handle(`/metrics`, promhttp.Handler())
+}
+
+// Pool exports the connections of the pool called name, replacing any pool exported under that name before.
+func Pool(name string, stats func() pool.Stats) {
+	pools.mu.Lock()
+	defer pools.mu.Unlock()
+	pools.stats[name] = stats
+}
+
+var pools = &poolCollector{
+	open:  prometheus.NewDesc(namespace+`_pool_open`, `Open connections of a pool.`, []string{`pool`}, nil),
+	inUse: prometheus.NewDesc(namespace+`_pool_in_use`, `Connections of a pool checked out.`, []string{`pool`}, nil),
+	stats: make(map[string]func() pool.Stats),
+}
+
+func init() {
+	prometheus.MustRegister(pools)
+	open, err := meter.Int64ObservableGauge(namespace+`.pool_open`, metric.WithDescription(`Open connections of a pool.`))
+	if err != nil {
+		otel.Handle(err)
+		return
+	}
+	inUse, err := meter.Int64ObservableGauge(namespace+`.pool_in_use`, metric.WithDescription(`Connections of a pool checked out.`))
+	if err != nil {
+		otel.Handle(err)
+		return
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		pools.mu.Lock()
+		defer pools.mu.Unlock()
+		for name, stats := range pools.stats {
+			s, attrs := stats(), metric.WithAttributes(attribute.String(`pool`, name))
+			o.ObserveInt64(open, int64(s.Open), attrs)
+			o.ObserveInt64(inUse, int64(s.InUse), attrs)
+		}
+		return nil
+	}, open, inUse)
+	if err != nil {
+		otel.Handle(err)
+	}
+}
+
+// poolCollector reads the stats of every pool when scraped.
+type poolCollector struct {
+	open, inUse *prometheus.Desc
+
+	mu    sync.Mutex // guards stats
+	stats map[string]func() pool.Stats
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.open
+	ch <- c.inUse
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, stats := range c.stats {
+		s := stats()
+		ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(s.Open), name)
+		ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(s.InUse), name)
+	}
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/pool"
+)
+
+func scrape() string {
+	mux := http.NewServeMux()
+	Register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	return w.Body.String()
+}
+
+func TestPool(t *testing.T) {
+	Pool(`posts`, func() pool.Stats { return pool.Stats{Open: 1} })
+	Pool(`posts`, func() pool.Stats { return pool.Stats{Open: 3, Idle: 1, InUse: 2} }) // e.g. a new backend
+	out := scrape()
+	assert.Contains(t, out, `supergraph_pool_open{pool="posts"} 3`)
+	assert.Contains(t, out, `supergraph_pool_in_use{pool="posts"} 2`)
+}
+
+func TestRegister(t *testing.T) {
+	Queries.WithLabelValues(`rows`).Observe(0.002)
+	out := scrape()
+	assert.Contains(t, out, `supergraph_db_query_duration_seconds_count{statement="rows"} 1`)
+	assert.Contains(t, out, `go_goroutines`, `runtime metrics`)
+}
+
+func TestOpenTelemetry(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithView(Views()...)))
+	Pool(`threads`, func() pool.Stats { return pool.Stats{Open: 2, InUse: 1} })
+
+	Queries.WithLabelValues(`page`).Observe(0.004)
+	BatchSize.Observe(12)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	got := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			got[m.Name] = m.Data
+		}
+	}
+	queries, ok := got[`supergraph.db_query_duration_seconds`].(metricdata.Histogram[float64])
+	require.True(t, ok, `recorded on the provider set after the instruments were created`)
+	require.Len(t, queries.DataPoints, 1)
+	statement, _ := queries.DataPoints[0].Attributes.Value(`statement`)
+	assert.Equal(t, `page`, statement.AsString())
+	assert.Equal(t, 0.004, queries.DataPoints[0].Sum)
+	assert.Equal(t, latency, queries.DataPoints[0].Bounds, `the buckets of the Prometheus histogram`)
+	assert.Contains(t, got, `supergraph.loader_batch_size`)
+	assert.Contains(t, got, `supergraph.pool_open`)
+}
@@ -0,0 +1,283 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by Get once the pool has been closed.
+var ErrClosed = errors.New(`pool: closed`)
+
+// Conn is a pooled connection.
+type Conn interface {
+	Close() error
+	Broken() bool // true once an encode/decode failed and the connection must be discarded
+}
+
+// Busy is optionally implemented by connections that still have work in flight after being Put back
+// (e.g. multiplexed requests awaiting responses); they are never evicted while busy.
+type Busy interface {
+	Busy() bool
+}
+
+type Config struct {
+	Min         int           // connections kept open (and redialed) in the background
+	Max         int           // upper bound on open connections; Get waits once reached
+	DialTimeout time.Duration // per dial attempt
+	IdleTimeout time.Duration // idle connections above Min are closed after this long
+	Backoff     time.Duration // delay after the first failed dial, doubling per failure
+	MaxBackoff  time.Duration
+}
+
+// Stats is a point in time snapshot of the pool.
+type Stats struct {
+	Open  int
+	Idle  int
+	InUse int
+}
+
+type idleConn[C Conn] struct {
+	conn  C
+	since time.Time
+}
+
+// Pool is a bounded set of connections created by a dial func.
+type Pool[C Conn] struct {
+	cfg  Config
+	dial func(ctx context.Context) (C, error)
+
+	slots chan struct{} // one token per open connection
+	avail chan struct{} // nudges a waiting Get after Put
+	done  chan struct{}
+
+	mu       sync.Mutex // guards everything below
+	idle     []idleConn[C]
+	closed   bool
+	failures int
+	retryAt  time.Time
+	lastErr  error
+}
+
+func New[C Conn](cfg Config, dial func(ctx context.Context) (C, error)) *Pool[C] {
+	if cfg.Max < 1 {
+		cfg.Max = 1
+	}
+	if cfg.Min > cfg.Max {
+		cfg.Min = cfg.Max
+	}
+	p := &Pool[C]{
+		cfg:   cfg,
+		dial:  dial,
+		slots: make(chan struct{}, cfg.Max),
+		avail: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	go p.maintain()
+	return p
+}
+
+// Get returns an idle connection, dials a new one when below Max, or waits for one to be Put back.
+func (p *Pool[C]) Get(ctx context.Context) (C, error) {
+	var zero C
+	for {
+		if c, ok, err := p.popIdle(); err != nil || ok {
+			return c, err
+		}
+		select {
+		case p.slots <- struct{}{}:
+			c, err := p.connect(ctx)
+			if err != nil {
+				<-p.slots
+				return zero, err
+			}
+			return c, nil
+		case <-p.avail:
+			continue
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		case <-p.done:
+			return zero, ErrClosed
+		}
+	}
+}
+
+// Put hands c back to the pool, discarding it if it is broken.
+func (p *Pool[C]) Put(c C) {
+	p.mu.Lock()
+	if p.closed || c.Broken() {
+		p.mu.Unlock()
+		p.discard(c)
+		return
+	}
+	p.idle = append(p.idle, idleConn[C]{conn: c, since: time.Now()})
+	p.mu.Unlock()
+	select {
+	case p.avail <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes every idle connection; connections still checked out are closed when Put back.
+func (p *Pool[C]) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	close(p.done)
+	p.mu.Unlock()
+
+	var errs []error
+	for _, ic := range idle {
+		errs = append(errs, p.discard(ic.conn))
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pool[C]) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	open := len(p.slots)
+	return Stats{
+		Open:  open,
+		Idle:  len(p.idle),
+		InUse: open - len(p.idle),
+	}
+}
+
+// popIdle returns the most recently used healthy idle connection, closing broken ones along the way.
+func (p *Pool[C]) popIdle() (C, bool, error) {
+	var zero C
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return zero, false, ErrClosed
+	}
+	for len(p.idle) > 0 {
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !ic.conn.Broken() {
+			return ic.conn, true, nil
+		}
+		go p.discard(ic.conn)
+	}
+	return zero, false, nil
+}
+
+// connect dials unless a recent failure put the pool in backoff, in which case it fails fast.
+func (p *Pool[C]) connect(ctx context.Context) (C, error) {
+	var zero C
+	p.mu.Lock()
+	if p.failures > 0 && time.Now().Before(p.retryAt) {
+		err := fmt.Errorf(`pool: backing off after %d failed dials: %w`, p.failures, p.lastErr)
+		p.mu.Unlock()
+		return zero, err
+	}
+	p.mu.Unlock()
+
+	if p.cfg.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.DialTimeout)
+		defer cancel()
+	}
+	c, err := p.dial(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failures++
+		p.lastErr = err
+		p.retryAt = time.Now().Add(p.backoff())
+		return zero, fmt.Errorf(`pool: dial: %w`, err)
+	}
+	p.failures = 0
+	p.lastErr = nil
+	return c, nil
+}
+
+// backoff doubles per consecutive failure, capped at MaxBackoff. Callers hold p.mu.
+func (p *Pool[C]) backoff() time.Duration {
+	d := p.cfg.Backoff
+	for i := 1; i < p.failures && d < p.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.cfg.MaxBackoff > 0 && d > p.cfg.MaxBackoff {
+		d = p.cfg.MaxBackoff
+	}
+	return d
+}
+
+func (p *Pool[C]) discard(c C) error {
+	<-p.slots
+	return c.Close()
+}
+
+// maintain evicts long idle connections and keeps Min connections open.
+func (p *Pool[C]) maintain() {
+	interval := p.cfg.IdleTimeout / 2
+	if interval <= 0 || interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.evict()
+		p.fill()
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *Pool[C]) evict() {
+	if p.cfg.IdleTimeout <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-p.cfg.IdleTimeout)
+	var stale []C
+	p.mu.Lock()
+	kept := p.idle[:0]
+	open := len(p.slots)
+	for _, ic := range p.idle { // oldest first
+		busy, _ := any(ic.conn).(Busy)
+		switch {
+		case ic.conn.Broken():
+			stale = append(stale, ic.conn)
+			open--
+		case ic.since.Before(cutoff) && open > p.cfg.Min && (busy == nil || !busy.Busy()):
+			stale = append(stale, ic.conn)
+			open--
+		default:
+			kept = append(kept, ic)
+		}
+	}
+	p.idle = kept
+	p.mu.Unlock()
+	for _, c := range stale {
+		p.discard(c)
+	}
+}
+
+func (p *Pool[C]) fill() {
+	for len(p.slots) < p.cfg.Min {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return // raced with Get, which is dialing instead
+		}
+		c, err := p.connect(context.Background())
+		if err != nil {
+			<-p.slots
+			return // retried on the next tick, subject to backoff
+		}
+		p.Put(c)
+	}
+}
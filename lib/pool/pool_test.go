@@ -0,0 +1,137 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeConn struct {
+	id     int32
+	broken atomic.Bool
+	closed atomic.Bool
+}
+
+func (c *fakeConn) Close() error { c.closed.Store(true); return nil }
+func (c *fakeConn) Broken() bool { return c.broken.Load() }
+
+type dialer struct {
+	dials atomic.Int32
+	fail  atomic.Bool
+}
+
+func (d *dialer) dial(ctx context.Context) (*fakeConn, error) {
+	n := d.dials.Add(1)
+	if d.fail.Load() {
+		return nil, errors.New(`connection refused`)
+	}
+	return &fakeConn{id: n}, nil
+}
+
+func TestReuse(t *testing.T) {
+	var d dialer
+	p := New(Config{Max: 2}, d.dial)
+	defer p.Close()
+
+	c, err := p.Get(context.Background())
+	require.NoError(t, err)
+	p.Put(c)
+	again, err := p.Get(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, c, again)
+	assert.Equal(t, Stats{Open: 1, InUse: 1}, p.Stats())
+}
+
+func TestMaxWaits(t *testing.T) {
+	var d dialer
+	p := New(Config{Max: 1}, d.dial)
+	defer p.Close()
+
+	c, err := p.Get(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.Get(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		p.Put(c)
+	}()
+	again, err := p.Get(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, c, again)
+	assert.Equal(t, int32(1), d.dials.Load())
+}
+
+func TestBrokenDiscarded(t *testing.T) {
+	var d dialer
+	p := New(Config{Max: 1}, d.dial)
+	defer p.Close()
+
+	c, err := p.Get(context.Background())
+	require.NoError(t, err)
+	c.broken.Store(true)
+	p.Put(c)
+	assert.True(t, c.closed.Load())
+
+	// the slot was freed, so a replacement can be dialed
+	again, err := p.Get(context.Background())
+	require.NoError(t, err)
+	assert.NotSame(t, c, again)
+}
+
+func TestBackoff(t *testing.T) {
+	var d dialer
+	d.fail.Store(true)
+	p := New(Config{Max: 2, Backoff: time.Hour}, d.dial)
+	defer p.Close()
+
+	_, err := p.Get(context.Background())
+	assert.ErrorContains(t, err, `connection refused`)
+	_, err = p.Get(context.Background())
+	assert.ErrorContains(t, err, `backing off`)
+	assert.Equal(t, int32(1), d.dials.Load(), `no dial while backing off`)
+	assert.Equal(t, Stats{}, p.Stats())
+}
+
+func TestMinAndIdleEviction(t *testing.T) {
+	var d dialer
+	p := New(Config{Min: 1, Max: 3, IdleTimeout: 20 * time.Millisecond}, d.dial)
+	defer p.Close()
+
+	require.Eventually(t, func() bool { return p.Stats().Idle == 1 }, time.Second, time.Millisecond)
+
+	var conns []*fakeConn
+	for i := 0; i < 3; i++ {
+		c, err := p.Get(context.Background())
+		require.NoError(t, err)
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		p.Put(c)
+	}
+	assert.Equal(t, Stats{Open: 3, Idle: 3}, p.Stats())
+
+	// evicted down to Min
+	require.Eventually(t, func() bool { return p.Stats() == Stats{Open: 1, Idle: 1} }, time.Second, time.Millisecond)
+}
+
+func TestClose(t *testing.T) {
+	var d dialer
+	p := New(Config{Max: 1}, d.dial)
+	c, err := p.Get(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	_, err = p.Get(context.Background())
+	assert.ErrorIs(t, err, ErrClosed)
+	p.Put(c)
+	assert.True(t, c.closed.Load())
+}
@@ -0,0 +1,180 @@
+// Package projection builds SELECT lists from the fields a caller asked for (see domain.ThreadsRequest.Fields),
+// so queries only pay for the columns that were requested.
+package projection
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+// Column is a projectable column of a T, scanned as a sql.NullInt64 (or a NullInt64Array when aggregated):
+// columns like created are nullable, and Set decides what a NULL leaves on the record.
+type Column[T any] struct {
+	Name string // domain.Field*; also used as a SQL alias
+	Expr string // SELECT expression
+	Set  func(record *T, v sql.NullInt64)
+}
+
+// Query is a SELECT whose column lists depend on the projection. Each part is repeated per projected column,
+// with %[1]s its expression and %[2]s its name, and the results fill the verbs of format in order.
+// One statement is prepared per distinct projection, on first use.
+type Query[T any] struct {
+	db      *sql.DB
+	format  string
+	parts   []string
+	columns map[string]Column[T]
+
+	mu    sync.Mutex // guards stmts
+	stmts map[string]*sql.Stmt
+}
+
+// Prepare validates format by preparing it without any projected columns.
+func Prepare[T any](ctx context.Context, db *sql.DB, columns []Column[T], format string, parts ...string) (*Query[T], error) {
+	q := &Query[T]{
+		db:      db,
+		format:  format,
+		parts:   parts,
+		columns: make(map[string]Column[T], len(columns)),
+		stmts:   make(map[string]*sql.Stmt),
+	}
+	for _, c := range columns {
+		q.columns[c.Name] = c
+	}
+	if _, _, err := q.Stmt(ctx, nil); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Stmt returns the statement selecting fields, along with the columns in the order they are selected.
+// Unknown fields are reported as domain.CodeInvalidArgument.
+func (q *Query[T]) Stmt(ctx context.Context, fields []string) (*sql.Stmt, []Column[T], error) {
+	key, query, cols, err := q.expand(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if stmt, ok := q.stmts[key]; ok {
+		return stmt, cols, nil
+	}
+	stmt, err := q.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf(`prepare(%s): %w`, key, err)
+	}
+	q.stmts[key] = stmt
+	return stmt, cols, nil
+}
+
+// Check runs the statement without projected columns with args, discarding its rows, to tell whether it still
+// works against the database.
+func (q *Query[T]) Check(ctx context.Context, args ...any) error {
+	stmt, _, err := q.Stmt(ctx, nil)
+	if err != nil {
+		return err
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// Close closes every statement prepared so far.
+func (q *Query[T]) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var errs []error
+	for key, stmt := range q.stmts {
+		errs = append(errs, stmt.Close())
+		delete(q.stmts, key)
+	}
+	return errors.Join(errs...)
+}
+
+// expand renders the query for fields, keyed by their sorted, deduplicated names.
+func (q *Query[T]) expand(fields []string) (string, string, []Column[T], error) {
+	names := append([]string(nil), fields...)
+	sort.Strings(names)
+	cols := make([]Column[T], 0, len(names))
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		c, ok := q.columns[name]
+		if !ok {
+			return ``, ``, nil, &domain.Error{
+				Code:    domain.CodeInvalidArgument,
+				Message: fmt.Sprintf(`unknown field %q`, name),
+			}
+		}
+		cols = append(cols, c)
+	}
+	keys := make([]string, len(cols))
+	for i, c := range cols {
+		keys[i] = c.Name
+	}
+	fill := make([]any, len(q.parts))
+	for i, part := range q.parts {
+		var b strings.Builder
+		for _, c := range cols {
+			fmt.Fprintf(&b, part, c.Expr, c.Name)
+		}
+		fill[i] = b.String()
+	}
+	return strings.Join(keys, `,`), fmt.Sprintf(q.format, fill...), cols, nil
+}
+
+// NullInt64Array scans a one-dimensional bigint[] whose elements may be NULL, which pq.Int64Array rejects.
+// A NULL array scans as an empty one.
+type NullInt64Array []sql.NullInt64
+
+func (a *NullInt64Array) Scan(src any) error {
+	var b []byte
+	switch src := src.(type) {
+	case nil:
+		*a = (*a)[:0]
+		return nil
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	default:
+		return fmt.Errorf(`projection: cannot scan %T into NullInt64Array`, src)
+	}
+	if len(b) < 2 || b[0] != '{' || b[len(b)-1] != '}' {
+		return fmt.Errorf(`projection: malformed bigint[] %q`, b)
+	}
+	out := (*a)[:0] // rows are read one at a time, so the previous row's elements are done with
+	for rest := b[1 : len(b)-1]; len(rest) > 0; {
+		el := rest
+		if i := bytes.IndexByte(rest, ','); i >= 0 {
+			el, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		if string(el) == `NULL` {
+			out = append(out, sql.NullInt64{})
+			continue
+		}
+		n, err := strconv.ParseInt(string(el), 10, 64)
+		if err != nil {
+			return fmt.Errorf(`projection: bigint[] element %d: %w`, len(out), err)
+		}
+		out = append(out, sql.NullInt64{Int64: n, Valid: true})
+	}
+	*a = out
+	return nil
+}
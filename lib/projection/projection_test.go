@@ -0,0 +1,76 @@
+package projection
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+type record struct{ a, b int64 }
+
+var query = &Query[record]{
+	format: `SELECT id%s FROM t GROUP BY x%s;`,
+	parts:  []string{`, %[1]s`, `, max(%[1]s) AS %[2]s`},
+	columns: map[string]Column[record]{
+		`a`: {Name: `a`, Expr: `col_a`},
+		`b`: {Name: `b`, Expr: `col_b + 1`},
+	},
+}
+
+func TestExpand(t *testing.T) {
+	key, sql, cols, err := query.expand(nil)
+	require.NoError(t, err)
+	assert.Equal(t, ``, key)
+	assert.Equal(t, `SELECT id FROM t GROUP BY x;`, sql)
+	assert.Empty(t, cols)
+
+	key, sql, cols, err = query.expand([]string{`b`, `a`, `b`})
+	require.NoError(t, err)
+	assert.Equal(t, `a,b`, key)
+	assert.Equal(t, `SELECT id, col_a, col_b + 1 FROM t GROUP BY x, max(col_a) AS a, max(col_b + 1) AS b;`, sql)
+	require.Len(t, cols, 2)
+	assert.Equal(t, `a`, cols[0].Name)
+	assert.Equal(t, `b`, cols[1].Name)
+}
+
+func TestExpandWithoutParts(t *testing.T) {
+	q := &Query[record]{format: `SELECT * FROM t;`, columns: query.columns}
+	key, sql, cols, err := q.expand([]string{`b`, `a`})
+	require.NoError(t, err)
+	assert.Equal(t, `a,b`, key, `keyed by the columns even if the query does not change`)
+	assert.Equal(t, `SELECT * FROM t;`, sql)
+	assert.Len(t, cols, 2)
+}
+
+func TestExpandUnknown(t *testing.T) {
+	_, _, _, err := query.expand([]string{`a`, `nope`})
+	var derr *domain.Error
+	require.ErrorAs(t, err, &derr)
+	assert.Equal(t, domain.CodeInvalidArgument, derr.Code)
+}
+
+func TestNullInt64Array(t *testing.T) {
+	null, one := sql.NullInt64{}, func(n int64) sql.NullInt64 { return sql.NullInt64{Int64: n, Valid: true} }
+	for src, want := range map[string]NullInt64Array{
+		`{}`:                    nil,
+		`{1}`:                   {one(1)},
+		`{-2,NULL,30}`:          {one(-2), null, one(30)},
+		`{NULL}`:                {null},
+		`{1700000000123456,42}`: {one(1700000000123456), one(42)},
+	} {
+		var a NullInt64Array
+		require.NoError(t, a.Scan([]byte(src)), src)
+		assert.Equal(t, want, a, src)
+	}
+
+	a := NullInt64Array{one(1)}
+	require.NoError(t, a.Scan(nil))
+	assert.Empty(t, a, `a NULL array`)
+	for _, src := range []any{`1,2`, []byte(`{1,x}`), 7} {
+		assert.Error(t, a.Scan(src), `%v`, src)
+	}
+}
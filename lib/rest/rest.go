@@ -0,0 +1,104 @@
+// Package rest serves the domain services as read-only HTTP/JSON endpoints, for debugging without a gob client.
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+// Handle serves GET requests with fn, writing its response as JSON. The request's context continues the caller's
+// trace (W3C traceparent headers). A non-nil *domain.Error from fn picks the status code; if the response is nil
+// too, the error alone is written.
+func Handle(fn func(r *http.Request) (any, *domain.Error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set(`Allow`, `GET, HEAD`)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		res, derr := fn(r.WithContext(ctx))
+		if res == nil {
+			res = struct {
+				Error *domain.Error `json:"error"`
+			}{derr}
+		}
+		w.Header().Set(`Content-Type`, `application/json`)
+		w.WriteHeader(Status(derr))
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Printf(`encode %s: %v`, r.URL, err)
+		}
+	}
+}
+
+// Status is the HTTP status code for a response carrying err (nil for success).
+func Status(err *domain.Error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	switch err.Code {
+	case domain.CodeInvalidArgument:
+		return http.StatusBadRequest
+	case domain.CodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case domain.CodeUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Int32 reads the query parameter name, or fallback if it is absent.
+func Int32(q url.Values, name string, fallback int32) (int32, *domain.Error) {
+	raw := q.Get(name)
+	if raw == `` {
+		return fallback, nil
+	}
+	v, err := strconv.ParseInt(raw, 10, 32)
+	if err != nil {
+		return 0, invalid(name, raw)
+	}
+	return int32(v), nil
+}
+
+// Int32s reads the comma separated query parameter name.
+func Int32s(q url.Values, name string) ([]int32, *domain.Error) {
+	var out []int32
+	for _, raw := range List(q, name) {
+		v, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			return nil, invalid(name, raw)
+		}
+		out = append(out, int32(v))
+	}
+	return out, nil
+}
+
+// List reads the comma separated query parameter name, which may also be repeated.
+func List(q url.Values, name string) []string {
+	var out []string
+	for _, v := range q[name] {
+		for _, item := range strings.Split(v, `,`) {
+			if item != `` {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+func invalid(name, raw string) *domain.Error {
+	return &domain.Error{
+		Code:    domain.CodeInvalidArgument,
+		Message: fmt.Sprintf(`%s: not an int32: %q`, name, raw),
+	}
+}
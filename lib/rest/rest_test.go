@@ -0,0 +1,68 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+func TestParams(t *testing.T) {
+	q := url.Values{`limit`: {`3`}, `threads`: {`1,2`, `3`}, `bad`: {`x`}}
+
+	limit, err := Int32(q, `limit`, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), limit)
+	limit, err = Int32(q, `missing`, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(10), limit)
+
+	threads, err := Int32s(q, `threads`)
+	assert.Nil(t, err)
+	assert.Equal(t, []int32{1, 2, 3}, threads)
+
+	_, err = Int32(q, `bad`, 0)
+	require.NotNil(t, err)
+	assert.Equal(t, domain.CodeInvalidArgument, err.Code)
+	_, err = Int32s(q, `bad`)
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusBadRequest, Status(err))
+}
+
+func TestHandle(t *testing.T) {
+	defer func(p propagation.TextMapPropagator) { otel.SetTextMapPropagator(p) }(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	h := Handle(func(r *http.Request) (any, *domain.Error) {
+		sc := trace.SpanContextFromContext(r.Context())
+		if r.URL.Query().Get(`fail`) != `` {
+			return nil, &domain.Error{Code: domain.CodeDeadlineExceeded, Message: `query: canceled`}
+		}
+		return map[string]string{`trace`: sc.TraceID().String()}, nil
+	})
+
+	r := httptest.NewRequest(http.MethodGet, `/threads`, nil)
+	r.Header.Set(`traceparent`, `00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01`)
+	w := httptest.NewRecorder()
+	h(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `application/json`, w.Header().Get(`Content-Type`))
+	assert.JSONEq(t, `{"trace": "4bf92f3577b34da6a3ce929d0e0e4736"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, `/threads?fail=1`, nil))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.JSONEq(t, `{"error": {"code": "DEADLINE_EXCEEDED", "message": "query: canceled"}}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, `/threads`, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
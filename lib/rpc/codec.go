@@ -0,0 +1,414 @@
+package rpc
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+// Codec encodes the domain types as the protobuf messages of supergraph.proto, so other languages can use code
+// generated from it while Go callers keep using lib/domain.
+type Codec struct{}
+
+func (Codec) Name() string { return `proto` }
+
+func (Codec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case *domain.ThreadsRequest:
+		return appendThreadsRequest(nil, v), nil
+	case *domain.ThreadsResponse:
+		return appendThreadsResponse(nil, v), nil
+	case *domain.PostsRequest:
+		return appendPostsRequest(nil, v), nil
+	case *domain.PostsResponse:
+		return appendPostsResponse(nil, v), nil
+	}
+	return nil, fmt.Errorf(`rpc: cannot marshal %T`, v)
+}
+
+func (Codec) Unmarshal(b []byte, v any) error {
+	switch v := v.(type) {
+	case *domain.ThreadsRequest:
+		*v = domain.ThreadsRequest{}
+		return parseThreadsRequest(b, v)
+	case *domain.ThreadsResponse:
+		*v = domain.ThreadsResponse{}
+		return parseThreadsResponse(b, v)
+	case *domain.PostsRequest:
+		*v = domain.PostsRequest{}
+		return parsePostsRequest(b, v)
+	case *domain.PostsResponse:
+		*v = domain.PostsResponse{}
+		return parsePostsResponse(b, v)
+	}
+	return fmt.Errorf(`rpc: cannot unmarshal %T`, v)
+}
+
+// encoding: fields holding their zero value are omitted, as proto3 does
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendMessage appends the message written by fn as field num.
+func appendMessage(b []byte, num protowire.Number, fn func([]byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, fn(nil))
+}
+
+// appendCreated appends an optional created field, set unless t is zero.
+func appendCreated(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(t.UnixMicro()))
+}
+
+func appendError(b []byte, num protowire.Number, e *domain.Error) []byte {
+	if e == nil {
+		return b
+	}
+	return appendMessage(b, num, func(b []byte) []byte {
+		b = appendString(b, 1, e.Code)
+		return appendString(b, 2, e.Message)
+	})
+}
+
+func appendCursor(b []byte, c domain.Cursor) []byte {
+	b = appendVarint(b, 1, uint64(c.Created))
+	return appendVarint(b, 2, uint64(c.ID))
+}
+
+func appendThreadsRequest(b []byte, req *domain.ThreadsRequest) []byte {
+	b = appendVarint(b, 1, uint64(req.Limit))
+	for _, field := range req.Fields {
+		b = appendString(b, 2, field)
+	}
+	if req.After != nil {
+		b = appendMessage(b, 3, func(b []byte) []byte { return appendCursor(b, *req.After) })
+	}
+	return appendVarint(b, 4, uint64(req.Chunk))
+}
+
+func appendThreadsResponse(b []byte, res *domain.ThreadsResponse) []byte {
+	for _, thread := range res.Threads {
+		b = appendMessage(b, 1, func(b []byte) []byte {
+			b = appendVarint(b, 1, uint64(thread.ID))
+			return appendCreated(b, 2, thread.Created)
+		})
+	}
+	b = appendError(b, 2, res.Error)
+	b = appendVarint(b, 3, uint64(res.Duration))
+	return appendVarint(b, 4, protowire.EncodeBool(res.More))
+}
+
+func appendPostsRequest(b []byte, req *domain.PostsRequest) []byte {
+	b = appendVarint(b, 1, uint64(req.Limit))
+	if len(req.Threads) > 0 { // packed
+		b = appendMessage(b, 2, func(b []byte) []byte {
+			for _, thread := range req.Threads {
+				b = protowire.AppendVarint(b, uint64(thread))
+			}
+			return b
+		})
+	}
+	for _, field := range req.Fields {
+		b = appendString(b, 3, field)
+	}
+	for thread, after := range req.After {
+		b = appendMessage(b, 4, func(b []byte) []byte { // map entry
+			b = appendVarint(b, 1, uint64(thread))
+			return appendMessage(b, 2, func(b []byte) []byte { return appendCursor(b, after) })
+		})
+	}
+	return b
+}
+
+func appendPostsResponse(b []byte, res *domain.PostsResponse) []byte {
+	for thread, posts := range res.Records {
+		b = appendMessage(b, 1, func(b []byte) []byte { // map entry
+			b = appendVarint(b, 1, uint64(thread))
+			return appendMessage(b, 2, func(b []byte) []byte {
+				for _, post := range posts {
+					b = appendMessage(b, 1, func(b []byte) []byte {
+						b = appendVarint(b, 1, uint64(post.ID))
+						b = appendVarint(b, 2, uint64(post.ThreadID))
+						return appendCreated(b, 3, post.Created)
+					})
+				}
+				return b
+			})
+		})
+	}
+	return appendError(b, 2, res.Error)
+}
+
+// decoding
+
+// parse calls fn with every field of the message in b. fn returns how many bytes of the field's value it
+// consumed, or 0 to skip a field it does not know.
+func parse(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := fn(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// varint consumes a varint into *v (any integer type).
+func varint[T ~int32 | ~int64 | ~uint64](typ protowire.Type, b []byte, v *T) int {
+	if typ != protowire.VarintType {
+		return 0
+	}
+	x, n := protowire.ConsumeVarint(b)
+	*v = T(x)
+	return n
+}
+
+// message consumes an embedded message, parsing it with fn.
+func message(typ protowire.Type, b []byte, fn func([]byte) error) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, nil
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	return n, fn(v)
+}
+
+func str(typ protowire.Type, b []byte, s *string) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	v, n := protowire.ConsumeString(b)
+	*s = v
+	return n
+}
+
+func created(typ protowire.Type, b []byte, t *time.Time) int {
+	var micros int64
+	n := varint(typ, b, &micros)
+	if n > 0 {
+		*t = time.UnixMicro(micros).UTC()
+	}
+	return n
+}
+
+func parseError(b []byte, e *domain.Error) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return str(typ, b, &e.Code), nil
+		case 2:
+			return str(typ, b, &e.Message), nil
+		}
+		return 0, nil
+	})
+}
+
+func parseCursor(b []byte, c *domain.Cursor) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return varint(typ, b, &c.Created), nil
+		case 2:
+			return varint(typ, b, &c.ID), nil
+		}
+		return 0, nil
+	})
+}
+
+// int32s consumes a repeated int32 field, packed or not.
+func int32s(typ protowire.Type, b []byte, v *[]int32) (int, error) {
+	var x int32
+	if n := varint(typ, b, &x); n != 0 {
+		*v = append(*v, x)
+		return n, nil
+	}
+	return message(typ, b, func(b []byte) error {
+		for len(b) > 0 {
+			n := varint(protowire.VarintType, b, &x)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*v = append(*v, x)
+			b = b[n:]
+		}
+		return nil
+	})
+}
+
+func parseThreadsRequest(b []byte, req *domain.ThreadsRequest) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return varint(typ, b, &req.Limit), nil
+		case 2:
+			var field string
+			n := str(typ, b, &field)
+			if n > 0 {
+				req.Fields = append(req.Fields, field)
+			}
+			return n, nil
+		case 3:
+			req.After = new(domain.Cursor)
+			return message(typ, b, func(b []byte) error { return parseCursor(b, req.After) })
+		case 4:
+			return varint(typ, b, &req.Chunk), nil
+		}
+		return 0, nil
+	})
+}
+
+func parseThreadsResponse(b []byte, res *domain.ThreadsResponse) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return message(typ, b, func(b []byte) error {
+				var thread domain.Thread
+				err := parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+					switch num {
+					case 1:
+						return varint(typ, b, &thread.ID), nil
+					case 2:
+						return created(typ, b, &thread.Created), nil
+					}
+					return 0, nil
+				})
+				res.Threads = append(res.Threads, thread)
+				return err
+			})
+		case 2:
+			res.Error = new(domain.Error)
+			return message(typ, b, func(b []byte) error { return parseError(b, res.Error) })
+		case 3:
+			return varint(typ, b, &res.Duration), nil
+		case 4:
+			var more uint64
+			n := varint(typ, b, &more)
+			res.More = protowire.DecodeBool(more)
+			return n, nil
+		}
+		return 0, nil
+	})
+}
+
+func parsePostsRequest(b []byte, req *domain.PostsRequest) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return varint(typ, b, &req.Limit), nil
+		case 2:
+			return int32s(typ, b, &req.Threads)
+		case 3:
+			var field string
+			n := str(typ, b, &field)
+			if n > 0 {
+				req.Fields = append(req.Fields, field)
+			}
+			return n, nil
+		case 4:
+			return message(typ, b, func(b []byte) error {
+				var thread int32
+				var after domain.Cursor
+				err := parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+					switch num {
+					case 1:
+						return varint(typ, b, &thread), nil
+					case 2:
+						return message(typ, b, func(b []byte) error { return parseCursor(b, &after) })
+					}
+					return 0, nil
+				})
+				if req.After == nil {
+					req.After = make(map[int32]domain.Cursor)
+				}
+				req.After[thread] = after
+				return err
+			})
+		}
+		return 0, nil
+	})
+}
+
+func parsePostsResponse(b []byte, res *domain.PostsResponse) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return message(typ, b, func(b []byte) error {
+				var thread int32
+				var posts []domain.Post
+				err := parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+					switch num {
+					case 1:
+						return varint(typ, b, &thread), nil
+					case 2:
+						return message(typ, b, func(b []byte) error { return parsePosts(b, &posts) })
+					}
+					return 0, nil
+				})
+				if res.Records == nil {
+					res.Records = make(map[int32][]domain.Post)
+				}
+				res.Records[thread] = posts
+				return err
+			})
+		case 2:
+			res.Error = new(domain.Error)
+			return message(typ, b, func(b []byte) error { return parseError(b, res.Error) })
+		}
+		return 0, nil
+	})
+}
+
+func parsePosts(b []byte, posts *[]domain.Post) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != 1 {
+			return 0, nil
+		}
+		return message(typ, b, func(b []byte) error {
+			var post domain.Post
+			err := parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				switch num {
+				case 1:
+					return varint(typ, b, &post.ID), nil
+				case 2:
+					return varint(typ, b, &post.ThreadID), nil
+				case 3:
+					return created(typ, b, &post.Created), nil
+				}
+				return 0, nil
+			})
+			*posts = append(*posts, post)
+			return err
+		})
+	})
+}
@@ -0,0 +1,249 @@
+package rpc
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protopath"
+	"google.golang.org/protobuf/reflect/protorange"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+// TestProto checks Codec against supergraph.proto: every message it encodes is read by the message of the
+// same name built from the .proto (as generated code would), field by field, and what that message encodes
+// is decoded back to the value it started from.
+func TestProto(t *testing.T) {
+	file := loadProto(t)
+	created := time.UnixMicro(1700000000123456).UTC()
+	for _, tc := range []struct {
+		msg  any
+		json string
+	}{
+		{
+			&domain.ThreadsRequest{Limit: 3, Fields: []string{domain.FieldCreated}, After: &domain.Cursor{Created: -1, ID: 7}, Chunk: 2},
+			`{"limit": 3, "fields": ["created"], "after": {"created": "-1", "id": 7}, "chunk": 2}`,
+		},
+		{
+			&domain.ThreadsResponse{Threads: []domain.Thread{{ID: 1, Created: created}, {ID: -2}}, Duration: time.Millisecond, More: true},
+			`{"threads": [{"id": 1, "created": "1700000000123456"}, {"id": -2}], "durationNs": "1000000", "more": true}`,
+		},
+		{
+			&domain.ThreadsResponse{Error: &domain.Error{Code: domain.CodeInternal, Message: `rows: bad connection`}},
+			`{"error": {"code": "INTERNAL", "message": "rows: bad connection"}}`,
+		},
+		{
+			&domain.PostsRequest{Limit: 20, Threads: []int32{1, 2}, Fields: []string{domain.FieldCreated}, After: map[int32]domain.Cursor{2: {Created: 5, ID: 6}}},
+			`{"limit": 20, "threads": [1, 2], "fields": ["created"], "after": {"2": {"created": "5", "id": 6}}}`,
+		},
+		{
+			&domain.PostsResponse{Records: map[int32][]domain.Post{1: {{ID: 10, ThreadID: 1, Created: created}, {ID: 11, ThreadID: 1}}}},
+			`{"records": {"1": {"posts": [{"id": 10, "threadId": 1, "created": "1700000000123456"}, {"id": 11, "threadId": 1}]}}}`,
+		},
+		{
+			&domain.PostsResponse{Error: &domain.Error{Code: domain.CodeInvalidArgument, Message: `limit`}},
+			`{"error": {"code": "INVALID_ARGUMENT", "message": "limit"}}`,
+		},
+	} {
+		name := reflect.TypeOf(tc.msg).Elem().Name()
+		t.Run(name, func(t *testing.T) {
+			desc := file.Messages().ByName(protoreflect.Name(name))
+			require.NotNil(t, desc, `declared in supergraph.proto`)
+
+			b, err := Codec{}.Marshal(tc.msg)
+			require.NoError(t, err)
+			msg := dynamicpb.NewMessage(desc)
+			require.NoError(t, proto.Unmarshal(b, msg))
+			require.NoError(t, protorange.Range(msg, func(v protopath.Values) error {
+				if m, ok := v.Index(-1).Value.Interface().(protoreflect.Message); ok {
+					assert.Empty(t, m.GetUnknown(), `unknown fields in %s`, v.Path)
+				}
+				return nil
+			}))
+			out, err := protojson.Marshal(msg)
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.json, string(out))
+
+			b, err = proto.Marshal(msg)
+			require.NoError(t, err)
+			got := newLike(tc.msg)
+			require.NoError(t, Codec{}.Unmarshal(b, got))
+			assert.Equal(t, tc.msg, got)
+		})
+	}
+}
+
+// loadProto builds the descriptor of supergraph.proto. It only parses what the file uses: messages of scalar,
+// message, repeated, optional and map fields; services and options are skipped.
+func loadProto(t *testing.T) protoreflect.FileDescriptor {
+	src, err := os.ReadFile(`supergraph.proto`)
+	require.NoError(t, err)
+	tokens := tokenize(string(src))
+	next := func() string {
+		require.NotEmpty(t, tokens, `unexpected end of supergraph.proto`)
+		tok := tokens[0]
+		tokens = tokens[1:]
+		return tok
+	}
+	expect := func(want string) {
+		t.Helper()
+		got := next()
+		require.Equal(t, want, got, `supergraph.proto`)
+	}
+	number := func() int32 {
+		n, err := strconv.Atoi(next())
+		require.NoError(t, err)
+		return int32(n)
+	}
+
+	file := &descriptorpb.FileDescriptorProto{Name: proto.String(`supergraph.proto`)}
+	typeName := func(name string) *string { return proto.String(`.` + file.GetPackage() + `.` + name) }
+	for len(tokens) > 0 {
+		switch tok := next(); tok {
+		case `syntax`:
+			expect(`=`)
+			file.Syntax = proto.String(strings.Trim(next(), `"`))
+			expect(`;`)
+		case `package`:
+			file.Package = proto.String(next())
+			expect(`;`)
+		case `option`:
+			for next() != `;` {
+			}
+		case `service`:
+			next()
+			expect(`{`)
+			for depth := 1; depth > 0; {
+				switch next() {
+				case `{`:
+					depth++
+				case `}`:
+					depth--
+				}
+			}
+		case `message`:
+			msg := &descriptorpb.DescriptorProto{Name: proto.String(next())}
+			expect(`{`)
+			for tok := next(); tok != `}`; tok = next() {
+				field := &descriptorpb.FieldDescriptorProto{Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+				switch tok {
+				case `map`:
+					expect(`<`)
+					key := next()
+					expect(`,`)
+					value := next()
+					expect(`>`)
+					field.Name = proto.String(next())
+					entry := &descriptorpb.DescriptorProto{
+						Name:    proto.String(camel(field.GetName()) + `Entry`),
+						Field:   []*descriptorpb.FieldDescriptorProto{scalar(key, 1, typeName), scalar(value, 2, typeName)},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					}
+					entry.Field[0].Name, entry.Field[1].Name = proto.String(`key`), proto.String(`value`)
+					msg.NestedType = append(msg.NestedType, entry)
+					field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+					field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+					field.TypeName = typeName(msg.GetName() + `.` + entry.GetName())
+				case `repeated`:
+					field = scalar(next(), 0, typeName)
+					field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+					field.Name = proto.String(next())
+				case `optional`:
+					field = scalar(next(), 0, typeName)
+					field.Name = proto.String(next())
+					field.Proto3Optional = proto.Bool(true)
+					field.OneofIndex = proto.Int32(int32(len(msg.OneofDecl)))
+					msg.OneofDecl = append(msg.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String(`_` + field.GetName())})
+				default:
+					field = scalar(tok, 0, typeName)
+					field.Name = proto.String(next())
+				}
+				expect(`=`)
+				field.Number = proto.Int32(number())
+				expect(`;`)
+				msg.Field = append(msg.Field, field)
+			}
+			file.MessageType = append(file.MessageType, msg)
+		default:
+			t.Fatalf(`supergraph.proto: unexpected %q`, tok)
+		}
+	}
+	fd, err := protodesc.NewFile(file, nil)
+	require.NoError(t, err)
+	return fd
+}
+
+// scalars are the scalar types of the .proto language used by supergraph.proto.
+var scalars = map[string]descriptorpb.FieldDescriptorProto_Type{
+	`bool`:   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	`int32`:  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	`int64`:  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	`string`: descriptorpb.FieldDescriptorProto_TYPE_STRING,
+}
+
+// scalar declares a field of type typ, a scalar or a message of the file.
+func scalar(typ string, number int32, typeName func(string) *string) *descriptorpb.FieldDescriptorProto {
+	field := &descriptorpb.FieldDescriptorProto{Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+	if number > 0 {
+		field.Number = proto.Int32(number)
+	}
+	if t, ok := scalars[typ]; ok {
+		field.Type = t.Enum()
+	} else {
+		field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+		field.TypeName = typeName(typ)
+	}
+	return field
+}
+
+// camel turns a field name into the name of its map entry, e.g. thread_ids into ThreadIds.
+func camel(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, `_`) {
+		if part != `` {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+// tokenize splits src into words, quoted strings and punctuation, dropping comments.
+func tokenize(src string) []string {
+	var tokens []string
+	for _, line := range strings.Split(src, "\n") {
+		line, _, _ = strings.Cut(line, `//`)
+		for i := 0; i < len(line); {
+			switch c := rune(line[i]); {
+			case unicode.IsSpace(c):
+				i++
+			case c == '"':
+				end := strings.IndexByte(line[i+1:], '"') + i + 2
+				tokens = append(tokens, line[i:end])
+				i = end
+			case strings.ContainsRune(`{}<>=;,()`, c):
+				tokens = append(tokens, string(c))
+				i++
+			default:
+				start := i
+				for i < len(line) && !unicode.IsSpace(rune(line[i])) && !strings.ContainsRune(`{}<>=;,()"`, rune(line[i])) {
+					i++
+				}
+				tokens = append(tokens, line[start:i])
+			}
+		}
+	}
+	return tokens
+}
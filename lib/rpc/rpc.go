@@ -0,0 +1,224 @@
+// Package rpc serves the threads and posts services over gRPC (see supergraph.proto), alongside their gob
+// listeners.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+// ThreadsServer implements supergraph.v1.Threads.
+type ThreadsServer interface {
+	List(*domain.ThreadsRequest, ThreadsStream) error
+}
+
+// ThreadsStream sends the responses to a Threads.List call.
+type ThreadsStream interface {
+	Context() context.Context // carries the caller's deadline and trace context
+	Send(*domain.ThreadsResponse) error
+}
+
+// PostsServer implements supergraph.v1.Posts.
+type PostsServer interface {
+	Batch(context.Context, *domain.PostsRequest) (*domain.PostsResponse, error)
+}
+
+var threadsService = grpc.ServiceDesc{
+	ServiceName: `supergraph.v1.Threads`,
+	HandlerType: (*ThreadsServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    `List`,
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			req := new(domain.ThreadsRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(ThreadsServer).List(req, threadsStream{stream})
+		},
+	}},
+	Metadata: `supergraph.proto`,
+}
+
+type threadsStream struct{ grpc.ServerStream }
+
+func (s threadsStream) Send(res *domain.ThreadsResponse) error { return s.SendMsg(res) }
+
+var postsService = grpc.ServiceDesc{
+	ServiceName: `supergraph.v1.Posts`,
+	HandlerType: (*PostsServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: `Batch`,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(domain.PostsRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handle := func(ctx context.Context, req any) (any, error) {
+				return srv.(PostsServer).Batch(ctx, req.(*domain.PostsRequest))
+			}
+			if interceptor == nil {
+				return handle(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: batchPosts}, handle)
+		},
+	}},
+	Metadata: `supergraph.proto`,
+}
+
+const (
+	listThreads = `/supergraph.v1.Threads/List`
+	batchPosts  = `/supergraph.v1.Posts/Batch`
+)
+
+// NewServer returns a gRPC server speaking Codec, which continues the callers' traces.
+func NewServer() *grpc.Server {
+	return grpc.NewServer(
+		grpc.ForceServerCodec(Codec{}),
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handle grpc.UnaryHandler) (any, error) {
+			return handle(extract(ctx), req)
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handle grpc.StreamHandler) error {
+			return handle(srv, tracedStream{stream, extract(stream.Context())})
+		}),
+	)
+}
+
+// Shutdown stops s from accepting calls and waits for those in flight, cancelling them if ctx ends first.
+func Shutdown(ctx context.Context, s *grpc.Server) error {
+	drained := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+func RegisterThreads(s *grpc.Server, srv ThreadsServer) { s.RegisterService(&threadsService, srv) }
+func RegisterPosts(s *grpc.Server, srv PostsServer)     { s.RegisterService(&postsService, srv) }
+
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s tracedStream) Context() context.Context { return s.ctx }
+
+// Ready connects cc if it is idle and waits until it is ready to carry calls, failing once ctx is done.
+func Ready(ctx context.Context, cc *grpc.ClientConn) error {
+	for {
+		state := cc.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Idle:
+			cc.Connect()
+		case connectivity.Shutdown:
+			return errors.New(`rpc: connection closed`)
+		}
+		if !cc.WaitForStateChange(ctx, state) {
+			return fmt.Errorf(`rpc: %v: %w`, state, ctx.Err())
+		}
+	}
+}
+
+// Dial connects to a server started with NewServer; connections are established lazily and shared by
+// concurrent calls.
+func Dial(target string) (*grpc.ClientConn, error) {
+	return grpc.Dial(target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(Codec{})),
+	)
+}
+
+// ListThreads starts a Threads.List call, returning a func that receives its responses in order (io.EOF
+// after the last one).
+func ListThreads(ctx context.Context, cc grpc.ClientConnInterface, req *domain.ThreadsRequest) (func() (*domain.ThreadsResponse, error), error) {
+	stream, err := cc.NewStream(inject(ctx), &threadsService.Streams[0], listThreads)
+	if err != nil {
+		return nil, Err(err)
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, Err(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, Err(err)
+	}
+	return func() (*domain.ThreadsResponse, error) {
+		res := new(domain.ThreadsResponse)
+		if err := stream.RecvMsg(res); err != nil {
+			return nil, Err(err)
+		}
+		return res, nil
+	}, nil
+}
+
+// BatchPosts calls Posts.Batch.
+func BatchPosts(ctx context.Context, cc grpc.ClientConnInterface, req *domain.PostsRequest) (*domain.PostsResponse, error) {
+	res := new(domain.PostsResponse)
+	if err := cc.Invoke(inject(ctx), batchPosts, req, res); err != nil {
+		return nil, Err(err)
+	}
+	return res, nil
+}
+
+// Err translates the gRPC status of a failed call back into the context errors that caused it, so callers
+// handle them as they do for gob; other errors are returned as is.
+func Err(err error) error {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded:
+		return errors.Join(context.DeadlineExceeded, err)
+	case codes.Canceled:
+		return errors.Join(context.Canceled, err)
+	}
+	return err
+}
+
+// carrier adapts gRPC metadata to trace context propagation.
+type carrier metadata.MD
+
+func (c carrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ``
+}
+
+func (c carrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+func (c carrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func inject(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	otel.GetTextMapPropagator().Inject(ctx, carrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+func extract(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return otel.GetTextMapPropagator().Extract(ctx, carrier(md))
+}
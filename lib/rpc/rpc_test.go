@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+func TestCodec(t *testing.T) {
+	created := time.UnixMicro(1700000000123456).UTC()
+	for _, msg := range []any{
+		&domain.ThreadsRequest{Limit: 3, Fields: []string{domain.FieldCreated}, After: &domain.Cursor{Created: -1, ID: 7}, Chunk: 2},
+		&domain.ThreadsResponse{Threads: []domain.Thread{{ID: 1, Created: created}, {ID: -2}}, Duration: time.Millisecond, More: true},
+		&domain.ThreadsResponse{Error: &domain.Error{Code: domain.CodeInternal, Message: `rows: bad connection`}},
+		&domain.PostsRequest{Limit: 20, Threads: []int32{1, 2}, After: map[int32]domain.Cursor{2: {Created: 5, ID: 6}, 1: {Created: domain.NullCreated, ID: 4}}},
+		&domain.PostsResponse{Records: map[int32][]domain.Post{
+			1: {{ID: 10, ThreadID: 1, Created: created}, {ID: 11, ThreadID: 1}},
+			2: nil,
+		}},
+	} {
+		b, err := Codec{}.Marshal(msg)
+		require.NoError(t, err)
+		got := newLike(msg)
+		require.NoError(t, Codec{}.Unmarshal(b, got))
+		assert.Equal(t, msg, got)
+	}
+
+	// wire format matches supergraph.proto
+	b, err := Codec{}.Marshal(&domain.PostsRequest{Limit: 1, Threads: []int32{2, 3}})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 1, 0x12, 2, 2, 3}, b)
+
+	// unknown fields are skipped and unpacked repeated fields accepted
+	var req domain.PostsRequest
+	require.NoError(t, Codec{}.Unmarshal([]byte{0x78, 9, 0x10, 2, 0x10, 3, 0x08, 1}, &req))
+	assert.Equal(t, domain.PostsRequest{Limit: 1, Threads: []int32{2, 3}}, req)
+	assert.Error(t, Codec{}.Unmarshal([]byte{0x08}, &req), `truncated`)
+}
+
+func newLike(msg any) any {
+	switch msg.(type) {
+	case *domain.ThreadsRequest:
+		return new(domain.ThreadsRequest)
+	case *domain.ThreadsResponse:
+		return new(domain.ThreadsResponse)
+	case *domain.PostsRequest:
+		return new(domain.PostsRequest)
+	}
+	return new(domain.PostsResponse)
+}
+
+type server struct{}
+
+func (server) List(req *domain.ThreadsRequest, stream ThreadsStream) error {
+	if req.Limit < 0 {
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	}
+	for i := int32(0); i < req.Limit; i++ {
+		if err := stream.Send(&domain.ThreadsResponse{Threads: []domain.Thread{{ID: i}}, More: true}); err != nil {
+			return err
+		}
+	}
+	return stream.Send(&domain.ThreadsResponse{Duration: time.Second})
+}
+
+func (server) Batch(ctx context.Context, req *domain.PostsRequest) (*domain.PostsResponse, error) {
+	res := &domain.PostsResponse{Records: make(map[int32][]domain.Post)}
+	for _, thread := range req.Threads {
+		res.Records[thread] = []domain.Post{{ID: thread * 10, ThreadID: thread}}
+	}
+	return res, nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	require.NoError(t, err)
+	s := NewServer()
+	RegisterThreads(s, server{})
+	RegisterPosts(s, server{})
+	go s.Serve(l)
+	defer s.Stop()
+	cc, err := Dial(l.Addr().String())
+	require.NoError(t, err)
+	defer cc.Close()
+	ctx := context.Background()
+
+	recv, err := ListThreads(ctx, cc, &domain.ThreadsRequest{Limit: 2})
+	require.NoError(t, err)
+	var frames []domain.ThreadsResponse
+	for {
+		res, err := recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		frames = append(frames, *res)
+	}
+	assert.Equal(t, []domain.ThreadsResponse{
+		{Threads: []domain.Thread{{ID: 0}}, More: true},
+		{Threads: []domain.Thread{{ID: 1}}, More: true},
+		{Duration: time.Second},
+	}, frames)
+
+	res, err := BatchPosts(ctx, cc, &domain.PostsRequest{Threads: []int32{1, 2}})
+	require.NoError(t, err)
+	assert.Equal(t, map[int32][]domain.Post{1: {{ID: 10, ThreadID: 1}}, 2: {{ID: 20, ThreadID: 2}}}, res.Records)
+
+	// deadlines propagate to the server, and back as context errors
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	recv, err = ListThreads(ctx, cc, &domain.ThreadsRequest{Limit: -1})
+	require.NoError(t, err)
+	_, err = recv()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
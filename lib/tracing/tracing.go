@@ -2,41 +2,212 @@ package tracing
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
 	"time"
 
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/env"
+	"github.com/bign8/supergraph-top-n-challenge/lib/metrics"
 )
 
-func Init(service string) {
-	client := otlptracegrpc.NewClient(
-		otlptracegrpc.WithInsecure(),
-	)
-	exporter, err := otlptrace.New(context.Background(), client)
+// SettingsError is returned by Init when the environment asks for something invalid: a bad value or an
+// unknown exporter. Other errors of Init come from starting the exporters.
+type SettingsError struct{ Err error }
+
+func (e *SettingsError) Error() string {
+	return `tracing settings: ` + e.Err.Error()
+}
+
+func (e *SettingsError) Unwrap() error {
+	return e.Err
+}
+
+// Init exports the spans and metrics (see lib/metrics) of service as configured by the environment:
+//
+//	TRACING_EXPORTER        otlp-grpc (default), otlp-http, stdout (spans only) or none
+//	TRACING_SAMPLE_RATIO    share of the root spans sampled, children follow their parent (default 1)
+//	TRACING_BATCH_SIZE      spans per export (default 512)
+//	TRACING_QUEUE_SIZE      spans buffered for export, dropped beyond (default 2048)
+//	TRACING_BATCH_TIMEOUT   longest a span waits to be exported (default 5s)
+//	TRACING_EXPORT_TIMEOUT  of one export (default 10s)
+//	METRICS_EXPORT_INTERVAL (default 10s)
+//	OTEL_METRICS_EXPORTER   otlp (default) or none, to export spans only
+//
+// The OTLP exporters read their endpoint from the usual OTEL_EXPORTER_OTLP_* variables: metrics go to the
+// same OTEL_EXPORTER_OTLP_ENDPOINT as spans unless OTEL_EXPORTER_OTLP_METRICS_ENDPOINT says otherwise. With
+// none nothing is installed, leaving the no-op providers of otel (for benchmarks). The returned func flushes
+// and stops exporting; it is never nil, so on error the service can run on without telemetry. Invalid
+// settings are reported as a *SettingsError, which services refuse to start on.
+func Init(service string) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	exporter := env.Default(`TRACING_EXPORTER`, `otlp-grpc`)
+	if exporter == `none` {
+		return noop, nil
+	}
+	c, err := configure()
+	switch exporter {
+	case `otlp-grpc`, `otlp-http`, `stdout`:
+	default:
+		err = errors.Join(err, fmt.Errorf(`unknown TRACING_EXPORTER: %q`, exporter))
+	}
+	if err != nil {
+		return noop, &SettingsError{Err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.exportTimeout)
+	defer cancel()
+
+	var spans trace.SpanExporter
+	var measures metric.Exporter // stays nil for stdout and when opted out
+	switch exporter {
+	case `otlp-grpc`:
+		spans, err = otlptracegrpc.New(ctx, otlptracegrpc.WithTimeout(c.exportTimeout))
+		if err == nil && c.metrics {
+			measures, err = otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithTimeout(c.exportTimeout))
+		}
+	case `otlp-http`:
+		spans, err = otlptracehttp.New(ctx, otlptracehttp.WithTimeout(c.exportTimeout))
+		if err == nil && c.metrics {
+			measures, err = otlpmetrichttp.New(ctx, otlpmetrichttp.WithTimeout(c.exportTimeout))
+		}
+	case `stdout`:
+		spans, err = stdouttrace.New()
+	}
 	if err != nil {
-		log.Fatal(`creating OTLP trace exporter: %w`, err)
+		if spans != nil {
+			err = errors.Join(err, spans.Shutdown(ctx))
+		}
+		return noop, fmt.Errorf(`creating %s exporter: %w`, exporter, err)
 	}
+
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(service),
+		semconv.ServiceVersion(version()),
+	)
 	tp := trace.NewTracerProvider(
-		trace.WithSampler(trace.AlwaysSample()), // for debugging
+		trace.WithSampler(trace.ParentBased(trace.TraceIDRatioBased(c.ratio))),
 		trace.WithBatcher(
-			exporter,
-			trace.WithBatchTimeout(time.Second), // for debugging
+			spans,
+			trace.WithMaxExportBatchSize(c.batchSize),
+			trace.WithMaxQueueSize(c.queueSize),
+			trace.WithBatchTimeout(c.batchTimeout),
+			trace.WithExportTimeout(c.exportTimeout),
 		),
-		trace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName(service),
-			semconv.ServiceVersion(`0.0.1`),
-		)),
+		trace.WithResource(res),
 	)
-
 	otel.SetTracerProvider(tp)
+	shutdown := []func(context.Context) error{tp.Shutdown}
+
+	if measures != nil {
+		mp := metric.NewMeterProvider(
+			metric.WithReader(metric.NewPeriodicReader(measures,
+				metric.WithInterval(c.interval),
+				metric.WithTimeout(c.exportTimeout),
+			)),
+			metric.WithResource(res),
+			metric.WithView(metrics.Views()...),
+		)
+		otel.SetMeterProvider(mp)
+		shutdown = append(shutdown, mp.Shutdown)
+	}
 
 	// by default propagate spans!
 	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func(ctx context.Context) error {
+		var errs []error
+		for _, stop := range shutdown {
+			errs = append(errs, stop(ctx))
+		}
+		return errors.Join(errs...)
+	}, nil
+}
+
+type config struct {
+	ratio                float64
+	batchSize, queueSize int
+	batchTimeout         time.Duration
+	exportTimeout        time.Duration
+	interval             time.Duration // of metrics exports
+	metrics              bool          // exported over OTLP along with the spans
+}
+
+// configure reads the environment variables listed on Init.
+func configure() (c config, err error) {
+	number := func(name, fallback string) int {
+		n, e := strconv.Atoi(env.Default(name, fallback))
+		if e == nil && n <= 0 {
+			e = errors.New(`must be positive`)
+		}
+		if e != nil {
+			err = errors.Join(err, fmt.Errorf(`%s: %w`, name, e))
+		}
+		return n
+	}
+	duration := func(name, fallback string) time.Duration {
+		d, e := time.ParseDuration(env.Default(name, fallback))
+		if e == nil && d <= 0 {
+			e = errors.New(`must be positive`)
+		}
+		if e != nil {
+			err = errors.Join(err, fmt.Errorf(`%s: %w`, name, e))
+		}
+		return d
+	}
+	raw := env.Default(`TRACING_SAMPLE_RATIO`, `1`)
+	if c.ratio, err = strconv.ParseFloat(raw, 64); err != nil || !(c.ratio >= 0 && c.ratio <= 1) {
+		err = fmt.Errorf(`TRACING_SAMPLE_RATIO: %q is not between 0 and 1`, raw)
+	}
+	c.batchSize = number(`TRACING_BATCH_SIZE`, `512`)
+	c.queueSize = number(`TRACING_QUEUE_SIZE`, `2048`)
+	c.batchTimeout = duration(`TRACING_BATCH_TIMEOUT`, `5s`)
+	c.exportTimeout = duration(`TRACING_EXPORT_TIMEOUT`, `10s`)
+	c.interval = duration(`METRICS_EXPORT_INTERVAL`, `10s`)
+	switch m := env.Default(`OTEL_METRICS_EXPORTER`, `otlp`); m {
+	case `otlp`:
+		c.metrics = true
+	case `none`:
+	default:
+		err = errors.Join(err, fmt.Errorf(`OTEL_METRICS_EXPORTER: %q is neither otlp nor none`, m))
+	}
+	return c, err
+}
+
+// version of the binary: its module version when installed, else the revision it was built from.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return `unknown`
+	}
+	if v := info.Main.Version; v != `` && v != `(devel)` {
+		return v
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case `vcs.revision`:
+			revision = s.Value
+		case `vcs.modified`:
+			if s.Value == `true` {
+				modified = `-dirty`
+			}
+		}
+	}
+	if revision == `` {
+		return `(devel)`
+	}
+	return revision[:min(12, len(revision))] + modified
 }
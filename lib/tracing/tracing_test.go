@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInitNone(t *testing.T) {
+	t.Setenv(`TRACING_EXPORTER`, `none`)
+	t.Setenv(`TRACING_SAMPLE_RATIO`, `ignored`)
+	flush, err := Init(`test`)
+	require.NoError(t, err)
+	assert.NoError(t, flush(context.Background()))
+	_, installed := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	assert.False(t, installed, `left the no-op provider`)
+}
+
+func TestInitErrors(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		`exporter`: {`TRACING_EXPORTER`: `zipkin`},
+		`ratio`:    {`TRACING_SAMPLE_RATIO`: `10%`},
+		`range`:    {`TRACING_SAMPLE_RATIO`: `1.5`},
+		`size`:     {`TRACING_BATCH_SIZE`: `0`},
+		`timeout`:  {`TRACING_BATCH_TIMEOUT`: `5`},
+		`metrics`:  {`OTEL_METRICS_EXPORTER`: `prometheus`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(`TRACING_EXPORTER`, `stdout`)
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			flush, err := Init(`test`)
+			var settings *SettingsError
+			assert.ErrorAs(t, err, &settings)
+			require.NotNil(t, flush, `so the service can run on`)
+			assert.NoError(t, flush(context.Background()))
+		})
+	}
+}
+
+func TestSampling(t *testing.T) {
+	t.Setenv(`TRACING_EXPORTER`, `stdout`)
+	t.Setenv(`TRACING_SAMPLE_RATIO`, `0`)
+	flush, err := Init(`test`)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		assert.NoError(t, flush(context.Background()))
+	})
+	assert.IsType(t, &sdktrace.TracerProvider{}, otel.GetTracerProvider())
+
+	// spans are left open, so nothing is printed
+	_, root := otel.Tracer(``).Start(context.Background(), `root`)
+	assert.False(t, root.SpanContext().IsSampled())
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	_, child := otel.Tracer(``).Start(trace.ContextWithRemoteSpanContext(context.Background(), parent), `child`)
+	assert.True(t, child.SpanContext().IsSampled(), `follows its sampled parent`)
+}
+
+func TestMetricsExporter(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		`shared`:   {},
+		`override`: {`OTEL_EXPORTER_OTLP_METRICS_ENDPOINT`: `http://collector:4318/v1/metrics`},
+		`none`:     {`OTEL_METRICS_EXPORTER`: `none`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(`TRACING_EXPORTER`, `otlp-http`)
+			t.Setenv(`OTEL_EXPORTER_OTLP_ENDPOINT`, `http://jaeger:4318`)
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			otel.SetMeterProvider(noop.NewMeterProvider())
+			flush, err := Init(`test`)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				otel.SetTracerProvider(trace.NewNoopTracerProvider())
+				otel.SetMeterProvider(noop.NewMeterProvider())
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel() // nothing to flush to
+				flush(ctx)
+			})
+			_, installed := otel.GetMeterProvider().(*sdkmetric.MeterProvider)
+			assert.Equal(t, name != `none`, installed)
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// msgpackCodec writes MessagePack (https://msgpack.org/): structs become maps keyed by field name and times
+// use the timestamp extension, so the stream is readable by any msgpack library.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string                   { return `msgpack` }
+func (msgpackCodec) NewEncoder(w io.Writer) Encoder { return &msgpackEncoder{w: w} }
+func (msgpackCodec) NewDecoder(r io.Reader) Decoder { return &msgpackDecoder{m: newMessage(r)} }
+
+var timeType = reflect.TypeOf(time.Time{})
+
+const extTimestamp = -1
+
+type msgpackEncoder struct {
+	w   io.Writer
+	buf []byte // reused across messages
+}
+
+func (e *msgpackEncoder) Encode(v any) error {
+	buf, err := appendMsgpack(e.buf[:0], reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	e.buf = buf
+	_, err = e.w.Write(buf)
+	return err
+}
+
+func appendMsgpack(b []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return append(b, 0xc0), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendMsgpackUint(b, v.Uint()), nil
+	case reflect.String:
+		b = appendMsgpackLen(b, v.Len(), 0xa0, 31, 0xda, 0xdb)
+		return append(b, v.String()...), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		b = appendMsgpackLen(b, v.Len(), 0x90, 15, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if b, err = appendMsgpack(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		b = appendMsgpackLen(b, v.Len(), 0x80, 15, 0xde, 0xdf)
+		for it := v.MapRange(); it.Next(); {
+			var err error
+			if b, err = appendMsgpack(b, it.Key()); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgpack(b, it.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		return appendMsgpack(b, v.Elem())
+	case reflect.Struct:
+		if v.Type() == timeType {
+			t := v.Interface().(time.Time)
+			if t.IsZero() {
+				return append(b, 0xc0), nil
+			}
+			b = append(b, 0xc7, 12, byte(extTimestamp&0xff)) // timestamp 96
+			b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+			return binary.BigEndian.AppendUint64(b, uint64(t.Unix())), nil
+		}
+		exported := 0
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				exported++
+			}
+		}
+		b = appendMsgpackLen(b, exported, 0x80, 15, 0xde, 0xdf)
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			name := v.Type().Field(i).Name
+			b = appendMsgpackLen(b, len(name), 0xa0, 31, 0xda, 0xdb)
+			b = append(b, name...)
+			var err error
+			if b, err = appendMsgpack(b, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf(`wire: msgpack cannot encode %v`, v.Type())
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendMsgpackUint(b, uint64(n))
+	case n >= -32:
+		return append(b, byte(int8(n))) // negative fixint
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(int8(n)))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+func appendMsgpackUint(b []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(b, byte(n)) // positive fixint
+	case n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xcf), n)
+}
+
+// appendMsgpackLen appends the header of a string, array or map of n items.
+func appendMsgpackLen(b []byte, n int, fix byte, fixMax int, c16, c32 byte) []byte {
+	switch {
+	case n <= fixMax:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, c16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, c32), uint32(n))
+}
+
+type msgpackDecoder struct {
+	m message
+}
+
+func (d *msgpackDecoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf(`wire: msgpack cannot decode into %T`, v)
+	}
+	c, err := d.m.r.ReadByte()
+	if err != nil {
+		return err // io.EOF between messages
+	}
+	d.m.reset(1)
+	return unexpectedEOF(d.decode(c, rv.Elem()))
+}
+
+// unexpectedEOF reports streams ending mid-message.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+var errMsgpackType = errors.New(`wire: msgpack type mismatch`)
+
+// decode decodes the value starting with c into v.
+func (d *msgpackDecoder) decode(c byte, v reflect.Value) error {
+	if c == 0xc0 {
+		v.SetZero()
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if c != 0xc2 && c != 0xc3 {
+			return errMsgpackType
+		}
+		v.SetBool(c == 0xc3)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := d.int(c)
+		v.SetInt(n)
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := d.int(c)
+		v.SetUint(uint64(n))
+		return err
+	case reflect.String:
+		s, err := d.string(c)
+		v.SetString(s)
+		return err
+	case reflect.Slice:
+		n, err := d.len(c, 0x90, 15, 0xdc, 0xdd)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 0, min(n, preallocate)))
+		for i := 0; i < n; i++ {
+			v.Grow(1)
+			v.SetLen(i + 1)
+			if err := d.next(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		n, err := d.len(c, 0x80, 15, 0xde, 0xdf)
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), min(n, preallocate))
+		key, value := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		for i := 0; i < n; i++ {
+			if err := d.next(key); err != nil {
+				return err
+			}
+			if err := d.next(value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+			value.SetZero()
+		}
+		v.Set(m)
+		return nil
+	case reflect.Pointer:
+		p := reflect.New(v.Type().Elem())
+		if err := d.decode(c, p.Elem()); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	case reflect.Struct:
+		if v.Type() == timeType {
+			var ext [15]byte // 0xc7, length, type, payload
+			ext[0] = c
+			if _, err := io.ReadFull(&d.m, ext[1:]); err != nil {
+				return err
+			}
+			if ext[0] != 0xc7 || ext[1] != 12 || int8(ext[2]) != extTimestamp {
+				return errMsgpackType
+			}
+			nsec := binary.BigEndian.Uint32(ext[3:])
+			sec := binary.BigEndian.Uint64(ext[7:])
+			v.Set(reflect.ValueOf(time.Unix(int64(sec), int64(nsec)).UTC()))
+			return nil
+		}
+		n, err := d.len(c, 0x80, 15, 0xde, 0xdf)
+		if err != nil {
+			return err
+		}
+		v.SetZero()
+		for i := 0; i < n; i++ {
+			c, err := d.m.ReadByte()
+			if err != nil {
+				return err
+			}
+			name, err := d.string(c)
+			if err != nil {
+				return err
+			}
+			if field := v.FieldByName(name); field.CanSet() {
+				err = d.next(field)
+			} else {
+				err = d.skip(0) // unknown field
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf(`wire: msgpack cannot decode into %v`, v.Type())
+}
+
+func (d *msgpackDecoder) next(v reflect.Value) error {
+	c, err := d.m.ReadByte()
+	if err != nil {
+		return err
+	}
+	return d.decode(c, v)
+}
+
+// int reads the integer starting with c.
+func (d *msgpackDecoder) int(c byte) (int64, error) {
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	}
+	var size int
+	switch c {
+	case 0xcc, 0xd0:
+		size = 1
+	case 0xcd, 0xd1:
+		size = 2
+	case 0xce, 0xd2:
+		size = 4
+	case 0xcf, 0xd3:
+		size = 8
+	default:
+		return 0, errMsgpackType
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(&d.m, buf[8-size:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint64(buf[:])
+	if c >= 0xd0 { // signed: sign extend
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	}
+	return int64(n), nil
+}
+
+func (d *msgpackDecoder) string(c byte) (string, error) {
+	var n int
+	var err error
+	if c == 0xd9 { // str 8 is only read, never written
+		var size byte
+		size, err = d.m.ReadByte()
+		n = int(size)
+	} else {
+		n, err = d.len(c, 0xa0, 31, 0xda, 0xdb)
+	}
+	if err != nil {
+		return ``, err
+	}
+	return d.m.readString(n)
+}
+
+// len reads the length of the string, array or map starting with c, checked against the rest of the message.
+func (d *msgpackDecoder) len(c, fix byte, fixMax int, c16, c32 byte) (int, error) {
+	var buf [4]byte
+	switch c {
+	case c16:
+		if _, err := io.ReadFull(&d.m, buf[:2]); err != nil {
+			return 0, err
+		}
+		return d.m.length(uint64(binary.BigEndian.Uint16(buf[:])))
+	case c32:
+		if _, err := io.ReadFull(&d.m, buf[:]); err != nil {
+			return 0, err
+		}
+		return d.m.length(uint64(binary.BigEndian.Uint32(buf[:])))
+	}
+	if c&^byte(fixMax) != fix {
+		return 0, errMsgpackType
+	}
+	return int(c & byte(fixMax)), nil
+}
+
+// maxSkipDepth bounds the nesting of the values skipped, which (unlike decoded ones) no Go type bounds.
+const maxSkipDepth = 32
+
+// skip reads past the next value, nested depth arrays or maps deep.
+func (d *msgpackDecoder) skip(depth int) error {
+	if depth > maxSkipDepth {
+		return fmt.Errorf(`wire: msgpack values nested over %d deep`, maxSkipDepth)
+	}
+	c, err := d.m.ReadByte()
+	if err != nil {
+		return err
+	}
+	var n int // bytes to discard
+	switch {
+	case c <= 0x7f, c >= 0xe0, c == 0xc0, c == 0xc2, c == 0xc3:
+	case c&0xf0 == 0x80, c == 0xde, c == 0xdf: // map
+		items, err := d.len(c, 0x80, 15, 0xde, 0xdf)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2*items; i++ {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+	case c&0xf0 == 0x90, c == 0xdc, c == 0xdd: // array
+		items, err := d.len(c, 0x90, 15, 0xdc, 0xdd)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < items; i++ {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+	case c&0xe0 == 0xa0, c == 0xd9, c == 0xda, c == 0xdb:
+		_, err := d.string(c)
+		return err
+	case c >= 0xcc && c <= 0xd3:
+		_, err := d.int(c)
+		return err
+	case c == 0xca:
+		n = 4
+	case c == 0xcb:
+		n = 8
+	case c == 0xc7: // ext 8
+		size, err := d.m.ReadByte()
+		if err != nil {
+			return err
+		}
+		n = 1 + int(size)
+	default:
+		return fmt.Errorf(`wire: msgpack cannot skip 0x%x`, c)
+	}
+	return d.m.Discard(n)
+}
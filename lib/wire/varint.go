@@ -0,0 +1,232 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+// varintCodec writes values back to back with no type information: integers as (zigzag) varints, strings,
+// slices and maps prefixed by their length, struct fields in declaration order. It is the smallest of the
+// codecs but only works between peers built from the same lib/domain.
+type varintCodec struct{}
+
+func (varintCodec) Name() string                   { return `varint` }
+func (varintCodec) NewEncoder(w io.Writer) Encoder { return &varintEncoder{w: w} }
+func (varintCodec) NewDecoder(r io.Reader) Decoder { return &varintDecoder{m: newMessage(r)} }
+
+type varintEncoder struct {
+	w   io.Writer
+	buf []byte // reused across messages
+}
+
+func (e *varintEncoder) Encode(v any) error {
+	buf, err := appendVarint(e.buf[:0], reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	e.buf = buf
+	_, err = e.w.Write(buf)
+	return err
+}
+
+// appendVarint appends v. Slices, maps and pointers are prefixed by their length + 1, so nil (0) survives
+// the round trip.
+func appendVarint(b []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return binary.AppendUvarint(b, v.Uint()), nil
+	case reflect.String:
+		b = binary.AppendUvarint(b, uint64(v.Len()))
+		return append(b, v.String()...), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(b, 0), nil
+		}
+		b = binary.AppendUvarint(b, uint64(v.Len())+1)
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if b, err = appendVarint(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, 0), nil
+		}
+		b = binary.AppendUvarint(b, uint64(v.Len())+1)
+		for it := v.MapRange(); it.Next(); {
+			var err error
+			if b, err = appendVarint(b, it.Key()); err != nil {
+				return nil, err
+			}
+			if b, err = appendVarint(b, it.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			return append(b, 0), nil
+		}
+		return appendVarint(append(b, 1), v.Elem())
+	case reflect.Struct:
+		if v.Type() == timeType {
+			t := v.Interface().(time.Time)
+			if t.IsZero() {
+				return append(b, 0), nil
+			}
+			b = binary.AppendVarint(append(b, 1), t.Unix())
+			return binary.AppendUvarint(b, uint64(t.Nanosecond())), nil
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			var err error
+			if b, err = appendVarint(b, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf(`wire: varint cannot encode %v`, v.Type())
+}
+
+type varintDecoder struct {
+	m message
+}
+
+func (d *varintDecoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf(`wire: varint cannot decode into %T`, v)
+	}
+	if _, err := d.m.r.Peek(1); err != nil {
+		return err // io.EOF between messages
+	}
+	d.m.reset(0)
+	return unexpectedEOF(d.decode(rv.Elem()))
+}
+
+func (d *varintDecoder) decode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.m.ReadByte()
+		v.SetBool(b != 0)
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := binary.ReadVarint(&d.m)
+		v.SetInt(n)
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := binary.ReadUvarint(&d.m)
+		v.SetUint(n)
+		return err
+	case reflect.String:
+		n, err := d.length(0)
+		if err != nil {
+			return err
+		}
+		s, err := d.m.readString(n)
+		v.SetString(s)
+		return err
+	case reflect.Slice:
+		n, err := d.length(1)
+		if err != nil || n < 0 {
+			v.SetZero()
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 0, min(n, preallocate)))
+		for i := 0; i < n; i++ {
+			v.Grow(1)
+			v.SetLen(i + 1)
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		n, err := d.length(1)
+		if err != nil || n < 0 {
+			v.SetZero()
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), min(n, preallocate))
+		key, value := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		for i := 0; i < n; i++ {
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+		return nil
+	case reflect.Pointer:
+		set, err := d.m.ReadByte()
+		if err != nil || set == 0 {
+			v.SetZero()
+			return err
+		}
+		p := reflect.New(v.Type().Elem())
+		if err := d.decode(p.Elem()); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	case reflect.Struct:
+		if v.Type() == timeType {
+			set, err := d.m.ReadByte()
+			if err != nil || set == 0 {
+				v.SetZero()
+				return err
+			}
+			sec, err := binary.ReadVarint(&d.m)
+			if err != nil {
+				return err
+			}
+			nsec, err := binary.ReadUvarint(&d.m)
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(time.Unix(sec, int64(nsec)).UTC()))
+			return nil
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if err := d.decode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf(`wire: varint cannot decode into %v`, v.Type())
+}
+
+// length reads the length of a string (offset 0) or of a slice or map (offset 1, where 0 is nil and yields -1),
+// checked against the rest of the message.
+func (d *varintDecoder) length(offset uint64) (int, error) {
+	n, err := binary.ReadUvarint(&d.m)
+	if err != nil {
+		return 0, err
+	}
+	if n < offset {
+		return -1, nil
+	}
+	return d.m.length(n - offset)
+}
@@ -0,0 +1,270 @@
+// Package wire abstracts the serialization of the gob-era protocol between the gateway and the services:
+// the same messages (lib/domain) over a TCP stream, in whichever Codec the client asked for when connecting.
+package wire
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/metrics"
+)
+
+// Codec encodes a stream of messages. Encoders and decoders are not safe for concurrent use.
+type Codec interface {
+	Name() string
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+type Encoder interface {
+	Encode(v any) error
+}
+
+// Decoder decodes the next message into v, a pointer. It returns io.EOF once the stream is done.
+type Decoder interface {
+	Decode(v any) error
+}
+
+var (
+	Gob     Codec = gobCodec{}     // self-describing, type information sent once per stream
+	JSON    Codec = jsonCodec{}    // newline delimited
+	Msgpack Codec = msgpackCodec{} // self-describing, structs as maps of field names
+	Varint  Codec = varintCodec{}  // positional: both ends must share the Go types
+)
+
+var codecs = map[string]Codec{}
+
+func init() {
+	for _, c := range []Codec{Gob, JSON, Msgpack, Varint} {
+		codecs[c.Name()] = c
+	}
+}
+
+// Lookup returns the codec called name.
+func Lookup(name string) (Codec, error) {
+	if c, ok := codecs[name]; ok {
+		return c, nil
+	}
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf(`wire: unknown codec %q (want one of %v)`, name, names)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string                   { return `gob` }
+func (gobCodec) NewEncoder(w io.Writer) Encoder { return gob.NewEncoder(w) }
+func (gobCodec) NewDecoder(r io.Reader) Decoder { return gob.NewDecoder(r) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                   { return `json` }
+func (jsonCodec) NewEncoder(w io.Writer) Encoder { return json.NewEncoder(w) }
+func (jsonCodec) NewDecoder(r io.Reader) Decoder { return json.NewDecoder(r) }
+
+// handshake
+//
+// A client that wants anything but gob starts the stream with hello, then the length of the codec's name
+// (one byte) and the name. The server answers accepted, or refused before closing the connection. gob never
+// writes an empty message, so streams that start with anything else are gob: clients and servers predating
+// the handshake keep working.
+const (
+	hello    = 0x00
+	refused  = 0x00
+	accepted = 0x01
+)
+
+// Connect asks the server at the other end of conn to speak c, returning the encoder and decoder to use.
+func Connect(conn io.ReadWriter, c Codec) (Encoder, Decoder, error) {
+	if c.Name() != Gob.Name() {
+		name := c.Name()
+		if _, err := conn.Write(append([]byte{hello, byte(len(name))}, name...)); err != nil {
+			return nil, nil, fmt.Errorf(`wire: hello: %w`, err)
+		}
+		var ack [1]byte
+		if _, err := io.ReadFull(conn, ack[:]); err != nil {
+			return nil, nil, fmt.Errorf(`wire: ack: %w`, err)
+		}
+		if ack[0] != accepted {
+			return nil, nil, fmt.Errorf(`wire: server refused codec %q`, name)
+		}
+	}
+	r := &firstRead{r: conn}
+	enc, dec := timed(c, c.NewEncoder(conn), c.NewDecoder(r), r)
+	return enc, dec, nil
+}
+
+// Accept reads the client's handshake from conn, if any, returning the codec it asked for (Gob without one)
+// with the encoder and decoder to use. A client that hangs up before sending anything yields io.EOF.
+func Accept(conn io.ReadWriter) (Codec, Encoder, Decoder, error) {
+	first := &firstRead{r: conn}
+	r := bufio.NewReader(first)
+	peek, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if peek[0] != hello {
+		enc, dec := timed(Gob, Gob.NewEncoder(conn), Gob.NewDecoder(r), first)
+		return Gob, enc, dec, nil
+	}
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, nil, nil, fmt.Errorf(`wire: hello: %w`, err)
+	}
+	name := make([]byte, head[1])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, nil, nil, fmt.Errorf(`wire: hello: %w`, err)
+	}
+	c, err := Lookup(string(name))
+	if err != nil {
+		conn.Write([]byte{refused})
+		return nil, nil, nil, err
+	}
+	if _, err := conn.Write([]byte{accepted}); err != nil {
+		return nil, nil, nil, fmt.Errorf(`wire: ack: %w`, err)
+	}
+	enc, dec := timed(c, c.NewEncoder(conn), c.NewDecoder(r), first)
+	return c, enc, dec, nil
+}
+
+// timed observes how long enc and dec take per message (see metrics.Wire). A decode is timed from the first
+// read of r, the stream under any buffering, that returns data: not while waiting for the message to arrive.
+func timed(c Codec, enc Encoder, dec Decoder, r *firstRead) (Encoder, Decoder) {
+	return timedEncoder{enc, metrics.Wire.WithLabelValues(c.Name(), `encode`)},
+		timedDecoder{dec, r, metrics.Wire.WithLabelValues(c.Name(), `decode`)}
+}
+
+type timedEncoder struct {
+	Encoder
+	took prometheus.Observer
+}
+
+func (e timedEncoder) Encode(v any) error {
+	start := time.Now()
+	err := e.Encoder.Encode(v)
+	e.took.Observe(time.Since(start).Seconds())
+	return err
+}
+
+type timedDecoder struct {
+	Decoder
+	r    *firstRead
+	took prometheus.Observer
+}
+
+func (d timedDecoder) Decode(v any) error {
+	start := time.Now()
+	d.r.at = time.Time{}
+	err := d.Decoder.Decode(v)
+	if err != nil {
+		return err
+	}
+	if d.r.at.After(start) { // it had to wait for data
+		start = d.r.at
+	}
+	d.took.Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// firstRead records when a read first returned data since at was last reset.
+type firstRead struct {
+	r  io.Reader
+	at time.Time
+}
+
+func (f *firstRead) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && f.at.IsZero() {
+		f.at = time.Now()
+	}
+	return n, err
+}
+
+// byteReader buffers r unless it can already read bytes one at a time.
+func byteReader(r io.Reader) *bufio.Reader {
+	if br, ok := r.(*bufio.Reader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// maxMessage bounds the bytes of one message read by the msgpack and varint decoders, which otherwise trust
+// the lengths written by the peer (gob has its own limit).
+const maxMessage = 64 << 20
+
+// preallocate caps the room made for a slice or map from its announced length: the rest grows as items arrive.
+const preallocate = 1 << 10
+
+var errTooBig = fmt.Errorf(`wire: message over %d bytes`, maxMessage)
+
+// message reads one message from r, counting its bytes against maxMessage.
+type message struct {
+	r    *bufio.Reader
+	left int
+}
+
+func newMessage(r io.Reader) message { return message{r: byteReader(r)} }
+
+func (m *message) reset(read int) {
+	m.left = maxMessage - read
+}
+
+func (m *message) ReadByte() (byte, error) {
+	if m.left <= 0 {
+		return 0, errTooBig
+	}
+	m.left--
+	return m.r.ReadByte()
+}
+
+func (m *message) Read(p []byte) (int, error) {
+	if m.left <= 0 {
+		return 0, errTooBig
+	}
+	if len(p) > m.left {
+		p = p[:m.left]
+	}
+	n, err := m.r.Read(p)
+	m.left -= n
+	return n, err
+}
+
+func (m *message) Discard(n int) error {
+	if n > m.left {
+		return errTooBig
+	}
+	n, err := m.r.Discard(n)
+	m.left -= n
+	return err
+}
+
+// length checks that n items, each written as at least one byte, fit in the rest of the message.
+func (m *message) length(n uint64) (int, error) {
+	if n > uint64(m.left) {
+		return 0, fmt.Errorf(`%w: length %d, %d bytes left`, errTooBig, n, m.left)
+	}
+	return int(n), nil
+}
+
+// readString reads a string of n bytes; long ones are allocated as their bytes arrive.
+func (m *message) readString(n int) (string, error) {
+	if n <= preallocate {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(m, buf)
+		return string(buf), err
+	}
+	var b strings.Builder
+	_, err := io.CopyN(&b, m, int64(n))
+	return b.String(), err
+}
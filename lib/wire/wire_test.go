@@ -0,0 +1,235 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bign8/supergraph-top-n-challenge/lib/domain"
+)
+
+var all = []Codec{Gob, JSON, Msgpack, Varint}
+
+func TestRoundTrip(t *testing.T) {
+	created := time.UnixMicro(1700000000123456).UTC()
+	for _, c := range all {
+		t.Run(c.Name(), func(t *testing.T) {
+			var buf bytes.Buffer
+			enc, dec := c.NewEncoder(&buf), c.NewDecoder(&buf)
+			roundTrip := func(in, out any) {
+				t.Helper()
+				require.NoError(t, enc.Encode(in))
+				require.NoError(t, dec.Decode(out))
+			}
+
+			req := domain.ThreadsRequest{ID: 1, Limit: 2, Version: domain.ThreadsVersion, Fields: []string{domain.FieldCreated},
+				After: &domain.Cursor{Created: -5, ID: 7}, Headers: map[string]string{`traceparent`: `00-abc`}}
+			var gotReq domain.ThreadsRequest
+			roundTrip(req, &gotReq)
+			assert.Equal(t, req, gotReq)
+
+			res := domain.ThreadsResponse{ID: 1, Threads: []domain.Thread{{ID: 1, Created: created}, {ID: 2}},
+				Error: &domain.Error{Code: domain.CodeInternal, Message: `boom`}, Duration: time.Millisecond, More: true}
+			var gotRes domain.ThreadsResponse
+			roundTrip(res, &gotRes)
+			assert.Equal(t, res, gotRes)
+
+			posts := domain.PostsResponse{ID: 3, Records: map[int32][]domain.Post{
+				1:   {{ID: 10, ThreadID: 1, Created: created}},
+				-70: {{ID: 1 << 30, ThreadID: -70}},
+			}, Packed: domain.PackedRecords{2: {{ID: 20, ThreadID: 2, Created: created}}}}
+			var gotPosts domain.PostsResponse
+			roundTrip(posts, &gotPosts)
+			assert.Equal(t, posts, gotPosts)
+
+			legacy := []int32{212991383, 1194533456} // version 0 threads responses
+			var gotLegacy []int32
+			roundTrip(legacy, &gotLegacy)
+			assert.Equal(t, legacy, gotLegacy)
+
+			assert.ErrorIs(t, dec.Decode(&gotRes), io.EOF, `end of stream`)
+		})
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	for _, c := range all {
+		t.Run(c.Name(), func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			accepted := make(chan Codec, 1)
+			go func() {
+				defer server.Close()
+				c, enc, dec, err := Accept(server)
+				if !assert.NoError(t, err) {
+					return
+				}
+				accepted <- c
+				var req domain.PostsRequest
+				if assert.NoError(t, dec.Decode(&req)) {
+					assert.NoError(t, enc.Encode(domain.PostsResponse{ID: req.ID}))
+				}
+			}()
+
+			enc, dec, err := Connect(client, c)
+			require.NoError(t, err)
+			require.NoError(t, enc.Encode(domain.PostsRequest{ID: 42}))
+			var res domain.PostsResponse
+			require.NoError(t, dec.Decode(&res))
+			assert.Equal(t, uint64(42), res.ID)
+			assert.Equal(t, c, <-accepted)
+		})
+	}
+
+	t.Run(`legacy`, func(t *testing.T) { // clients predating the handshake speak gob right away
+		server, client := net.Pipe()
+		defer client.Close()
+		go func() {
+			_, _, dec, err := Accept(server)
+			if assert.NoError(t, err) {
+				var req domain.PostsRequest
+				assert.NoError(t, dec.Decode(&req))
+				assert.Equal(t, uint64(7), req.ID)
+			}
+			server.Close()
+		}()
+		require.NoError(t, gob.NewEncoder(client).Encode(domain.PostsRequest{ID: 7}))
+		io.Copy(io.Discard, client)
+	})
+
+	t.Run(`unknown`, func(t *testing.T) {
+		server, client := net.Pipe()
+		defer client.Close()
+		go func() {
+			_, _, _, err := Accept(server)
+			assert.ErrorContains(t, err, `unknown codec "xml"`)
+			server.Close()
+		}()
+		_, _, err := Connect(client, named(`xml`))
+		assert.ErrorContains(t, err, `refused codec "xml"`)
+	})
+}
+
+type named string
+
+func (n named) Name() string                 { return string(n) }
+func (named) NewEncoder(w io.Writer) Encoder { return Gob.NewEncoder(w) }
+func (named) NewDecoder(r io.Reader) Decoder { return Gob.NewDecoder(r) }
+
+// BenchmarkPostsResponse measures encoding and decoding a posts response of threads x posts records over one
+// stream per codec, as a connection would carry them, reporting the bytes sent per message.
+func BenchmarkPostsResponse(b *testing.B) {
+	for _, shape := range []struct{ threads, posts int }{{4, 20}, {100, 100}} {
+		res := domain.PostsResponse{ID: 1, Records: make(map[int32][]domain.Post, shape.threads)}
+		for thread := int32(0); thread < int32(shape.threads); thread++ {
+			posts := make([]domain.Post, shape.posts)
+			for i := range posts {
+				posts[i] = domain.Post{ID: 1_000_000_000 + thread*int32(shape.posts) + int32(i), ThreadID: thread}
+			}
+			res.Records[1_000_000_000+thread] = posts
+		}
+		for _, c := range all {
+			b.Run(fmt.Sprintf(`%dx%d/%s`, shape.threads, shape.posts, c.Name()), func(b *testing.B) {
+				var buf bytes.Buffer
+				enc, dec := c.NewEncoder(&buf), c.NewDecoder(&buf)
+				var sent int
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if err := enc.Encode(res); err != nil {
+						b.Fatal(err)
+					}
+					sent += buf.Len()
+					var out domain.PostsResponse
+					if err := dec.Decode(&out); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(sent)/float64(b.N), `bytes/msg`)
+			})
+		}
+	}
+}
+
+type observed []float64
+
+func (o *observed) Observe(v float64) { *o = append(*o, v) }
+
+func TestTimedDecodeSkipsWaiting(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond) // idle connection
+		Gob.NewEncoder(server).Encode(domain.PostsRequest{ID: 1})
+		server.Close()
+	}()
+
+	var took observed
+	r := &firstRead{r: client}
+	dec := timedDecoder{Gob.NewDecoder(r), r, &took}
+	var req domain.PostsRequest
+	require.NoError(t, dec.Decode(&req))
+	assert.Equal(t, uint64(1), req.ID)
+	require.Len(t, took, 1)
+	assert.Less(t, took[0], 0.04, `timed from the message's arrival`)
+}
+
+func TestDecodeOversized(t *testing.T) {
+	huge := func(prefix ...byte) []byte { return binary.AppendUvarint(prefix, 1<<62) }
+	for _, tc := range []struct {
+		codec Codec
+		name  string
+		in    []byte
+		into  any
+	}{
+		{Varint, `slice`, huge(), new([]int32)},
+		{Varint, `map`, huge(), new(map[int32][]int32)},
+		{Varint, `string`, huge(1, 2, 2, 2), new(domain.ThreadsRequest)}, // ID, Limit, Version, one field
+		{Varint, `overflow`, binary.AppendUvarint(nil, math.MaxUint64), new([]int32)},
+		{Msgpack, `slice`, []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, new([]int32)},
+		{Msgpack, `map`, []byte{0xdf, 0xff, 0xff, 0xff, 0xff}, new(map[int32][]int32)},
+		{Msgpack, `string`, []byte{0xdb, 0xff, 0xff, 0xff, 0xff}, new(string)},
+		{Msgpack, `skipped`, []byte{0x81, 0xa4, 'N', 'o', 'p', 'e', 0xdd, 0xff, 0xff, 0xff, 0xff}, new(domain.Error)},
+	} {
+		t.Run(tc.codec.Name()+`/`+tc.name, func(t *testing.T) {
+			err := tc.codec.NewDecoder(bytes.NewReader(tc.in)).Decode(tc.into)
+			assert.ErrorIs(t, err, errTooBig)
+		})
+	}
+
+	t.Run(`msgpack/nested`, func(t *testing.T) {
+		in := append([]byte{0x81, 0xa4, 'N', 'o', 'p', 'e'}, bytes.Repeat([]byte{0x91}, 1<<20)...) // [[[[...]]]]
+		err := Msgpack.NewDecoder(bytes.NewReader(in)).Decode(new(domain.Error))
+		assert.ErrorContains(t, err, `nested`)
+	})
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	messages := []any{
+		domain.ThreadsRequest{ID: 1, Limit: 2, Fields: []string{domain.FieldCreated}, Headers: map[string]string{`a`: `b`}},
+		domain.PostsResponse{ID: 3, Records: map[int32][]domain.Post{1: {{ID: 10, ThreadID: 1, Created: time.Unix(1, 0)}}}},
+	}
+	for _, c := range []Codec{Msgpack, Varint} {
+		t.Run(c.Name(), func(t *testing.T) {
+			for _, msg := range messages {
+				var buf bytes.Buffer
+				require.NoError(t, c.NewEncoder(&buf).Encode(msg))
+				full := buf.Bytes()
+				for n := 1; n < len(full); n++ {
+					into := reflect.New(reflect.TypeOf(msg)).Interface()
+					err := c.NewDecoder(bytes.NewReader(full[:n])).Decode(into)
+					assert.ErrorIs(t, err, io.ErrUnexpectedEOF, `%T cut at %d of %d bytes`, msg, n, len(full))
+				}
+			}
+		})
+	}
+}